@@ -1,40 +1,164 @@
 package spdy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	framing "github.com/kr/spdy/spdyframing"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Conn represents a SPDY client connection.
 // It implements http.RoundTripper for making HTTP requests.
 type Conn struct {
 	Conn net.Conn
-	s    *framing.Session
-	once sync.Once
+
+	// ModifyRequestHeader, if non-nil, is called with the
+	// header block of every request just before it is sent,
+	// after the SPDY-specific ':' fields have been added.
+	// It may add, change, or delete fields.
+	ModifyRequestHeader func(http.Header)
+
+	// Timeout specifies a time limit for each request made
+	// with RoundTrip. It includes opening the stream, waiting
+	// for the reply, and reading the response body. When it
+	// expires, the stream is reset. Zero means no timeout.
+	Timeout time.Duration
+
+	// KeepAlive, if positive, makes the connection send PING
+	// after it has been idle this long, and close if the server
+	// doesn't answer. See framing.Session.KeepAlive.
+	KeepAlive time.Duration
+
+	// HeaderCompressionLevel, if non-nil, is the zlib level
+	// used to compress request header blocks. See the field
+	// of the same name in Server. If the level is invalid,
+	// RoundTrip, OpenRequest, and Ready return an error.
+	HeaderCompressionLevel *int
+
+	// LogFrames makes the connection log every frame it sends
+	// or receives through ErrorLog. See the field of the same
+	// name in Server.
+	LogFrames bool
+
+	// ErrorLog specifies an optional logger for problems with
+	// requests that aren't errors, such as fields that SPDY
+	// doesn't allow. If nil, logging goes to os.Stderr via
+	// the log package's standard logger.
+	ErrorLog *log.Logger
+
+	s      *framing.Session
+	err    error // from start, if the session can't run
+	once   sync.Once
+	teOnce sync.Once // warn about Transfer-Encoding
 }
 
-// RoundTrip implements interface http.RoundTripper.
-func (c *Conn) RoundTrip(r *http.Request) (*http.Response, error) {
+// NewClientConn returns a Conn for making requests on c,
+// with its session already running. If c is a *tls.Conn,
+// NewClientConn first completes the handshake, if needed,
+// and returns an error if it didn't choose spdy/3, so that
+// a failed negotiation shows up here rather than in the
+// first request. It doesn't close c in that case, so the
+// caller can use c for the protocol that was chosen.
+//
+// Since the session starts at once, the fields of Conn that
+// configure it, such as KeepAlive, have no effect if set
+// on the result. To use them, make a Conn literal instead.
+func NewClientConn(c net.Conn) (*Conn, error) {
+	if tc, ok := c.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		if p := tc.ConnectionState().NegotiatedProtocol; p != "spdy/3" {
+			return nil, fmt.Errorf("spdy: negotiated protocol %q, not spdy/3", p)
+		}
+	}
+	conn := &Conn{Conn: c}
+	if err := conn.start(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// start starts the session on c, if it isn't already
+// running. It returns an error if c's settings are invalid,
+// in which case the session never runs.
+func (c *Conn) start() error {
 	c.once.Do(func() {
 		fr := framing.NewFramer(c.Conn, c.Conn)
-		c.s = framing.Start(fr, false, func(s *framing.Stream) {
+		if p := c.HeaderCompressionLevel; p != nil {
+			if err := fr.SetCompressionLevel(*p); err != nil {
+				c.err = fmt.Errorf("spdy: HeaderCompressionLevel %d: %v", *p, err)
+			}
+		}
+		c.s = framing.NewSession(fr, false, func(s *framing.Stream) {
 			// TODO(kr): Make each stream available
 			//           to its associated request.
 			s.Reset(framing.RefusedStream)
 		})
+		c.s.KeepAlive = c.KeepAlive
+		c.s.Logf = c.logf
+		if c.LogFrames {
+			c.s.LogFrame = frameLogger(c.logf, c.Conn.RemoteAddr())
+		}
+		if c.err == nil {
+			go c.s.Run()
+		}
 	})
+	return c.err
+}
+
+// Ready starts the session on c, if it isn't already
+// running, and checks that the server is responding
+// with PING. It returns an error if the server fails
+// to answer before ctx is done.
+func (c *Conn) Ready(ctx context.Context) error {
+	if err := c.start(); err != nil {
+		return err
+	}
+	_, err := c.s.Ping(ctx)
+	return err
+}
+
+// RoundTrip implements interface http.RoundTripper.
+// Once the connection has closed, it returns
+// framing.ErrSessionClosing, and if the server's GOAWAY
+// says it didn't process the request, framing.ErrGoingAway;
+// either way, the caller can retry the request on a new
+// connection. If the server resets the stream before it
+// replies, the error has the status; see framing.ResetStatus.
+func (c *Conn) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, _, err := c.roundTrip(r)
+	return resp, err
+}
+
+// roundTrip is RoundTrip, but it also reports whether it
+// opened a stream for r, after which r.Body may be partly read.
+func (c *Conn) roundTrip(r *http.Request) (resp *http.Response, opened bool, err error) {
+	if err := c.start(); err != nil {
+		return nil, false, err
+	}
+	if len(r.TransferEncoding) > 0 || r.Header.Get("Transfer-Encoding") != "" {
+		c.teOnce.Do(func() {
+			c.logf("spdy: ignoring Transfer-Encoding; SPDY sends the body in DATA frames")
+		})
+	}
 	reqHeader, flag, err := RequestFramingHeader(r)
 	body := r.Body
 	r.Body = nil
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	st, err := c.s.Open(reqHeader, flag)
+	st, err := c.open(reqHeader, flag)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if body != nil {
 		go func() {
@@ -46,12 +170,161 @@ func (c *Conn) RoundTrip(r *http.Request) (*http.Response, error) {
 			st.Close()
 		}()
 	}
+	var timer *time.Timer
+	var timedOut int32
+	if c.Timeout > 0 {
+		timer = time.AfterFunc(c.Timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			st.Reset(framing.Cancel)
+		})
+	}
+	resp, err = readResponse(st, r)
+	if err != nil {
+		if timer != nil {
+			timer.Stop()
+		}
+		if atomic.LoadInt32(&timedOut) != 0 {
+			return nil, true, timeoutError{}
+		}
+		return nil, true, err
+	}
+	if timer != nil {
+		resp.Body = &timeoutBody{resp.Body, timer, &timedOut}
+	}
+	return resp, true, nil
+}
+
+// OpenRequest starts the request r, but instead of sending
+// r.Body, which must be nil, it returns reqBody for the caller
+// to write the body to. Closing reqBody ends the request.
+// Function resp waits for the response and returns it.
+// The caller may go on writing to reqBody after the response
+// arrives, for a full-duplex exchange. Conn.Timeout does not
+// apply to requests made this way.
+func (c *Conn) OpenRequest(r *http.Request) (reqBody io.WriteCloser, resp func() (*http.Response, error), err error) {
+	if r.Body != nil {
+		return nil, nil, errors.New("spdy: OpenRequest with non-nil Body")
+	}
+	if err := c.start(); err != nil {
+		return nil, nil, err
+	}
+	r1 := *r
+	r1.Body = http.NoBody // keep the stream open for writing
+	reqHeader, flag, err := RequestFramingHeader(&r1)
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := c.open(reqHeader, flag)
+	if err != nil {
+		return nil, nil, err
+	}
+	return st, func() (*http.Response, error) { return readResponse(st, r) }, nil
+}
+
+// NumStreams returns the number of streams open on c,
+// such as requests whose response body hasn't been
+// read to the end or closed.
+func (c *Conn) NumStreams() int {
+	c.start()
+	return c.s.NumStreams()
+}
+
+func (c *Conn) logf(format string, args ...interface{}) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (c *Conn) open(h http.Header, flag framing.ControlFlags) (*framing.Stream, error) {
+	if c.ModifyRequestHeader != nil {
+		c.ModifyRequestHeader(h)
+	}
+	return c.s.Open(h, flag)
+}
+
+// readResponse waits for the reply on st and
+// reads the response to r from it. If st closes first,
+// it returns the reset error or framing.ErrGoingAway
+// that closed it, or else errNoReply.
+func readResponse(st *framing.Stream, r *http.Request) (*http.Response, error) {
 	h := st.Header() // waits for SYN_REPLY
-	resp, err := ReadResponse(h, nil, st, r)
+	if h == nil {
+		err := st.Err()
+		if _, ok := framing.ResetStatus(err); ok || err == framing.ErrGoingAway {
+			return nil, err
+		}
+		return nil, errNoReply
+	}
+	var trailer http.Header
+	if _, ok := h["Trailer"]; ok {
+		trailer = st.Trailer
+	}
+	resp, err := ReadResponse(h, trailer, st, r)
 	if err != nil {
 		st.Reset(framing.ProtocolError)
 		return nil, err
 	}
+	if b, ok := resp.Body.(*body); ok {
+		b.st = st
+	}
 	resp.Request = r
 	return resp, nil
 }
+
+// ResponseStream returns the stream that carried resp, if it
+// came from Conn, or else nil. It finds the stream through
+// resp.Body, so it works only while that is the body Conn
+// returned, not a wrapper around it.
+func ResponseStream(resp *http.Response) *framing.Stream {
+	if b, ok := resp.Body.(interface{ stream() *framing.Stream }); ok {
+		return b.stream()
+	}
+	return nil
+}
+
+// IsSPDY reports whether resp came over SPDY, as a response
+// from Conn does, rather than from some other RoundTripper,
+// such as one that fell back to HTTP/1.1. See ResponseStream.
+func IsSPDY(resp *http.Response) bool {
+	return ResponseStream(resp) != nil
+}
+
+var errNoReply = errors.New("spdy: stream closed before reply")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "spdy: request timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// timeoutBody reports a timeout error if Conn.Timeout
+// expires while the response body is being read.
+type timeoutBody struct {
+	rc       io.ReadCloser
+	timer    *time.Timer
+	timedOut *int32
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if err == io.EOF {
+		b.timer.Stop()
+	} else if err != nil && atomic.LoadInt32(b.timedOut) != 0 {
+		err = timeoutError{}
+	}
+	return n, err
+}
+
+func (b *timeoutBody) stream() *framing.Stream {
+	if b, ok := b.rc.(interface{ stream() *framing.Stream }); ok {
+		return b.stream()
+	}
+	return nil
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	return b.rc.Close()
+}
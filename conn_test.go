@@ -1,11 +1,22 @@
 package spdy
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	framing "github.com/kr/spdy/spdyframing"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -179,6 +190,2004 @@ func TestConnGetBodyUnknownLen(t *testing.T) {
 	}
 }
 
+func TestConnTrailerContentLength(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Header().Set("Trailer", "X-Sum")
+		io.WriteString(w, "hello")
+		w.Header().Set("X-Sum", "42")
+	}), sconn)
+
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if g := string(b); g != "hello" {
+		t.Errorf("Body = %q want %q", g, "hello")
+	}
+	if g := resp.Trailer.Get("X-Sum"); g != "42" {
+		t.Errorf("Trailer X-Sum = %q want %q", g, "42")
+	}
+}
+
+// A trailers-only response, as gRPC sends for an immediate
+// error, has SYN_REPLY, no DATA, then HEADERS with FLAG_FIN.
+func TestConnTrailersOnly(t *testing.T) {
+	testConnTrailersOnly(t, nil)
+	testConnTrailersOnly(t, http.Header{"content-length": {"0"}})
+}
+
+func testConnTrailersOnly(t *testing.T, extra http.Header) {
+	cconn, sconn := pipeConn()
+	defer sconn.Close()
+	go func() {
+		fr := framing.NewFramer(sconn, sconn)
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		id := f.(*framing.SynStreamFrame).StreamId
+		h := http.Header{
+			":status":      {"200"},
+			":version":     {"HTTP/1.1"},
+			"content-type": {"application/grpc"},
+			"trailer":      {"Grpc-Status"},
+		}
+		copyHeader(h, extra)
+		fr.WriteFrame(&framing.SynReplyFrame{StreamId: id, Headers: h})
+		// Give the client time to reach the end of the body,
+		// so it must wait for the trailer.
+		time.Sleep(20 * time.Millisecond)
+		hf := &framing.HeadersFrame{
+			StreamId: id,
+			Headers:  http.Header{"grpc-status": {"5"}},
+		}
+		hf.CFHeader.Flags = framing.ControlFlagFin
+		fr.WriteFrame(hf)
+	}()
+
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if g := resp.Header.Get("Content-Type"); g != "application/grpc" {
+		t.Errorf("Content-Type = %q want %q", g, "application/grpc")
+	}
+	if g := resp.Header.Get("Grpc-Status"); g != "" {
+		t.Errorf("Header Grpc-Status = %q want empty", g)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if len(b) > 0 {
+		t.Errorf("Body = %q want empty", b)
+	}
+	if g := resp.Trailer.Get("Grpc-Status"); g != "5" {
+		t.Errorf("Trailer Grpc-Status = %q want %q", g, "5")
+	}
+}
+
+func TestConnOpenRequest(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, echoHandler(t), sconn)
+
+	conn := &Conn{Conn: cconn}
+	req, _ := http.NewRequest("POST", "http://example.com/", nil)
+	body, getResp, err := conn.OpenRequest(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	// The echo reply comes only after the first write.
+	if _, err := io.WriteString(body, "ping0"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := getResp()
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	buf := make([]byte, 5)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			fmt.Fprintf(body, "ping%d", i)
+		}
+		if _, err := io.ReadFull(resp.Body, buf); err != nil {
+			t.Fatal(err)
+		}
+		if g, w := string(buf), fmt.Sprintf("ping%d", i); g != w {
+			t.Errorf("read %q want %q", g, w)
+		}
+	}
+	body.Close()
+	if b, err := ioutil.ReadAll(resp.Body); err != nil || len(b) > 0 {
+		t.Errorf("ReadAll = %q, %v want empty, nil", b, err)
+	}
+}
+
+// With frames held in the write buffer, Flush is what gets
+// an interactive handler's replies to the client.
+func TestServerFlushWriteBuffer(t *testing.T) {
+	cconn, sconn := pipeConn()
+	s := &Server{WriteFlushInterval: time.Hour}
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ready\n")
+		w.(http.Flusher).Flush()
+		br := bufio.NewReader(r.Body)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(w, strings.ToUpper(line))
+			w.(http.Flusher).Flush()
+		}
+	})
+	go s.ServeConn(sconn)
+
+	req, _ := http.NewRequest("POST", "http://example.com/", nil)
+	body, getResp, err := (&Conn{Conn: cconn}).OpenRequest(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	defer body.Close()
+	resp, err := getResp()
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	br := bufio.NewReader(resp.Body)
+	if line, err := br.ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("read %q, %v want %q", line, err, "ready\n")
+	}
+	for _, send := range []string{"a\n", "b\n"} {
+		io.WriteString(body, send)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		if w := strings.ToUpper(send); line != w {
+			t.Errorf("read %q want %q", line, w)
+		}
+	}
+}
+
+func TestServerFullDuplex(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Respond before reading anything.
+		io.WriteString(w, "ready\n")
+		br := bufio.NewReader(r.Body)
+		for {
+			line, err := br.ReadString('\n')
+			if err == io.EOF {
+				break // the client sent FLAG_FIN
+			} else if err != nil {
+				t.Error("handler unexpected err", err)
+				return
+			}
+			io.WriteString(w, strings.ToUpper(line))
+		}
+		io.WriteString(w, "done\n")
+	}), sconn)
+
+	req, _ := http.NewRequest("POST", "http://example.com/", nil)
+	body, getResp, err := (&Conn{Conn: cconn}).OpenRequest(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp, err := getResp()
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	br := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		return line
+	}
+	if g := readLine(); g != "ready\n" {
+		t.Errorf("got %q want %q", g, "ready\n")
+	}
+	for _, s := range []string{"a\n", "b\n"} {
+		io.WriteString(body, s)
+		if g, w := readLine(), strings.ToUpper(s); g != w {
+			t.Errorf("got %q want %q", g, w)
+		}
+	}
+	body.Close()
+	if g := readLine(); g != "done\n" {
+		t.Errorf("got %q want %q", g, "done\n")
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("err = %v want EOF", err)
+	}
+}
+
+func TestConnChunkedBody(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != -1 {
+			t.Errorf("ContentLength = %d want -1", r.ContentLength)
+		}
+		if len(r.TransferEncoding) > 0 {
+			t.Errorf("TransferEncoding = %q want none", r.TransferEncoding)
+		}
+		io.Copy(w, r.Body) // returns at FLAG_FIN
+	}), sconn)
+
+	var logbuf bytes.Buffer
+	conn := &Conn{Conn: cconn, ErrorLog: log.New(&logbuf, "", 0)}
+	for i := 0; i < 2; i++ {
+		body := strings.Repeat("x", 100000)
+		req, _ := http.NewRequest("POST", "http://example.com/", ioutil.NopCloser(strings.NewReader(body)))
+		req.TransferEncoding = []string{"chunked"}
+		resp, err := conn.RoundTrip(req)
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		if string(b) != body {
+			t.Errorf("echoed %d bytes want %d", len(b), len(body))
+		}
+	}
+	if n := strings.Count(logbuf.String(), "Transfer-Encoding"); n != 1 {
+		t.Errorf("logged %d warnings want 1: %q", n, logbuf.String())
+	}
+}
+
+func TestConnModifyHeader(t *testing.T) {
+	cconn, sconn := pipeConn()
+	s := &Server{ModifyResponseHeader: func(h http.Header) {
+		h.Set("X-Frame-Options", "deny")
+		h.Del("X-Secret")
+	}}
+	s.Handler = echoHandler(t)
+	go s.ServeConn(sconn)
+
+	conn := &Conn{Conn: cconn, ModifyRequestHeader: func(h http.Header) {
+		h.Set("X-Client", "1")
+		h.Del("User-Agent")
+	}}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Secret", "shh")
+	resp, err := conn.RoundTrip(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	want := http.Header{
+		"Content-Type":    {"text/plain"},
+		"X-Client":        {"1"},
+		"X-Frame-Options": {"deny"},
+	}
+	if !reflect.DeepEqual(resp.Header, want) {
+		t.Errorf("Header = %v want %v", resp.Header, want)
+	}
+}
+
+func TestConnTimeout(t *testing.T) {
+	cconn, sconn := pipeConn()
+	stall := make(chan bool)
+	defer close(stall)
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stall
+	}), sconn)
+
+	const timeout = 50 * time.Millisecond
+	conn := &Conn{Conn: cconn, Timeout: timeout}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	t0 := time.Now()
+	_, err := conn.RoundTrip(req)
+	if d := time.Since(t0); d < timeout {
+		t.Errorf("RoundTrip returned after %v want at least %v", d, timeout)
+	}
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("err = %v want timeout", err)
+	}
+}
+
+func TestServerContextCancel(t *testing.T) {
+	cconn, sconn := pipeConn()
+	canceled := make(chan bool, 1)
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			canceled <- false
+		}
+	}), sconn)
+
+	conn := &Conn{Conn: cconn, Timeout: 10 * time.Millisecond}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if _, err := conn.RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip succeeded, want timeout")
+	}
+	if !<-canceled {
+		t.Error("request context not canceled after client reset")
+	}
+}
+
+func TestConnPartialContent(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g := r.Header.Get("Range"); g != "bytes=2-6" {
+			t.Errorf("Range = %q want %q", g, "bytes=2-6")
+		}
+		w.Header().Set("Content-Range", "bytes 2-6/10")
+		w.Header().Set("Content-Length", "5")
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, "23456")
+	}), sconn)
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Range", "bytes=2-6")
+	resp, err := (&http.Client{Transport: &Conn{Conn: cconn}}).Do(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("StatusCode = %d want %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	if resp.ContentLength != 5 {
+		t.Errorf("ContentLength = %d want 5", resp.ContentLength)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if string(b) != "23456" {
+		t.Errorf("body = %q want %q", b, "23456")
+	}
+	resp.Body.Close()
+}
+
+func TestConnResponseTooLong(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer sconn.Close()
+	// Our server won't send more than Content-Length,
+	// so play a server that does.
+	reset := make(chan framing.RstStreamStatus, 1)
+	go func() {
+		fr := framing.NewFramer(sconn, sconn)
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		id := f.(*framing.SynStreamFrame).StreamId
+		fr.WriteFrame(&framing.SynReplyFrame{
+			StreamId: id,
+			Headers: http.Header{
+				":status":        {"200"},
+				":version":       {"HTTP/1.1"},
+				"content-length": {"3"},
+			},
+		})
+		fr.WriteFrame(&framing.DataFrame{StreamId: id, Data: []byte("abcdef")})
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f, ok := f.(*framing.RstStreamFrame); ok {
+				reset <- f.Status
+				return
+			}
+		}
+	}()
+
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if string(b) != "abc" {
+		t.Errorf("body = %q want %q", b, "abc")
+	}
+	select {
+	case g := <-reset:
+		if g != framing.ProtocolError {
+			t.Errorf("RST_STREAM status = %d want %d", g, framing.ProtocolError)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("stream not reset after too much data")
+	}
+}
+
+// A handler that writes less than its declared Content-Length
+// fails the response, rather than leave the client to find
+// a short body. HEAD responses have no body to check.
+func TestServerContentLengthShort(t *testing.T) {
+	cconn, sconn := pipeConn()
+	srv := &Server{}
+	srv.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.WriteHeader(200)
+		if r.Method != "HEAD" {
+			io.WriteString(w, "abc")
+		}
+	})
+	go srv.ServeConn(sconn)
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		t.Errorf("read short body %q with no error", b)
+	}
+
+	resp, err = client.Head("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ContentLength != 10 {
+		t.Errorf("HEAD = %d, Content-Length %d want 200, 10", resp.StatusCode, resp.ContentLength)
+	}
+}
+
+func TestConnResponseTooShort(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer sconn.Close()
+	// A server that ends the stream before Content-Length.
+	go func() {
+		fr := framing.NewFramer(sconn, sconn)
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		id := f.(*framing.SynStreamFrame).StreamId
+		fr.WriteFrame(&framing.SynReplyFrame{
+			StreamId: id,
+			Headers: http.Header{
+				":status":        {"200"},
+				":version":       {"HTTP/1.1"},
+				"content-length": {"10"},
+			},
+		})
+		fr.WriteFrame(&framing.DataFrame{StreamId: id, Data: []byte("abc"), Flags: framing.DataFlagFin})
+		io.Copy(ioutil.Discard, sconn)
+	}()
+
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("err = %v want %v", err, io.ErrUnexpectedEOF)
+	}
+	if string(b) != "abc" {
+		t.Errorf("body = %q want %q", b, "abc")
+	}
+}
+
+// Closing a response body before the end resets the stream,
+// freeing it at once instead of waiting for the rest.
+func TestConnCloseUnreadBody(t *testing.T) {
+	cconn, sconn := pipeConn()
+	big := strings.Repeat("x", 200<<10)
+	wrote := make(chan error, 1)
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/big" {
+			return
+		}
+		_, err := io.WriteString(w, big)
+		wrote <- err
+	}), sconn)
+
+	conn := &Conn{Conn: cconn}
+	client := &http.Client{Transport: conn}
+	resp, err := client.Get("http://example.com/big")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 10)); err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if n := conn.NumStreams(); n != 1 {
+		t.Errorf("NumStreams = %d before Close want 1", n)
+	}
+	resp.Body.Close()
+	if n := conn.NumStreams(); n != 0 {
+		t.Errorf("NumStreams = %d after Close want 0", n)
+	}
+	if err := <-wrote; err == nil {
+		t.Error("handler wrote the whole body to a reset stream")
+	}
+
+	// The connection is still good for other requests.
+	resp, err = client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if n := conn.NumStreams(); n != 0 {
+		t.Errorf("NumStreams = %d after second request want 0", n)
+	}
+}
+
+// A handler that writes all of a declared Content-Length
+// ends the body with it, not with an empty DATA frame.
+func TestServerContentLengthFin(t *testing.T) {
+	tests := []struct {
+		body []string
+		want []string // DATA payloads; the last has FLAG_FIN
+	}{
+		{nil, nil},
+		{[]string{"hello"}, []string{"hello"}},
+		{[]string{"hel", "lo"}, []string{"hel", "lo"}},
+		{[]string{"hello", "excess"}, []string{"hello"}},
+	}
+	for i, tt := range tests {
+		cconn, sconn := pipeConn()
+		werrs := make(chan []error, 1)
+		go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(strings.Join(tt.want, ""))))
+			var errs []error
+			for _, s := range tt.body {
+				_, err := io.WriteString(w, s)
+				errs = append(errs, err)
+			}
+			werrs <- errs
+		}), sconn)
+		fr := framing.NewFramer(cconn, cconn)
+		err := fr.WriteFrame(&framing.SynStreamFrame{
+			StreamId: 1,
+			Headers: http.Header{
+				":scheme":  {"http"},
+				":method":  {"GET"},
+				":path":    {"/"},
+				":version": {"HTTP/1.1"},
+			},
+			CFHeader: framing.ControlFrameHeader{Flags: framing.ControlFlagFin},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		fin := false
+		for !fin {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch f := f.(type) {
+			case *framing.SynReplyFrame:
+				fin = f.CFHeader.Flags&framing.ControlFlagFin != 0
+			case *framing.DataFrame:
+				got = append(got, string(f.Data))
+				fin = f.Flags&framing.DataFlagFin != 0
+			default:
+				t.Fatalf("#%d: got %s", i, framing.DumpFrame(f))
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("#%d: DATA = %q want %q", i, got, tt.want)
+		}
+		for j, err := range <-werrs {
+			if j < len(tt.want) && err != nil {
+				t.Errorf("#%d: Write err = %v", i, err)
+			} else if j >= len(tt.want) && err != http.ErrContentLength {
+				t.Errorf("#%d: Write err = %v want %v", i, err, http.ErrContentLength)
+			}
+		}
+		cconn.Close()
+	}
+}
+
+func TestServerContextAfterFin(t *testing.T) {
+	cconn, sconn := pipeConn()
+	finished := make(chan bool)
+	errc := make(chan error, 2)
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		io.WriteString(w, "hello") // sends FLAG_FIN
+		<-finished
+		// Both sides are done with the stream, but the
+		// handler isn't, so the context must still be live.
+		select {
+		case <-r.Context().Done():
+			errc <- r.Context().Err()
+		case <-time.After(20 * time.Millisecond):
+			errc <- nil
+		}
+		// A dead connection still cancels it.
+		cconn.Close()
+		select {
+		case <-r.Context().Done():
+			errc <- nil
+		case <-time.After(5 * time.Second):
+			errc <- fmt.Errorf("context not canceled after connection closed")
+		}
+	}), sconn)
+	fr := framing.NewFramer(cconn, cconn)
+	err := fr.WriteFrame(&framing.SynStreamFrame{
+		StreamId: 1,
+		Headers: http.Header{
+			":scheme":  {"http"},
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+		},
+		CFHeader: framing.ControlFrameHeader{Flags: framing.ControlFlagFin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f, ok := f.(*framing.DataFrame); ok && f.Flags&framing.DataFlagFin != 0 {
+			break
+		}
+	}
+	close(finished)
+	if err := <-errc; err != nil {
+		t.Errorf("after FLAG_FIN, context err = %v want nil", err)
+	}
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerStreamContext(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st, ok := r.Context().Value(StreamContextKey).(*framing.Stream)
+		if !ok {
+			t.Error("no stream in request context")
+			return
+		}
+		if hs := st.HeaderSize(); hs.Wire == 0 || hs.Decoded == 0 {
+			t.Errorf("HeaderSize = %+v want nonzero", hs)
+		}
+		if id, ok := StreamID(r.Context()); id != st.Id() || !ok {
+			t.Errorf("StreamID = %d, %v want %d, true", id, ok, st.Id())
+		}
+	}), sconn)
+
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+}
+
+// The id from StreamID in a handler is the one the
+// client chose in SYN_STREAM, not a count of requests.
+func TestServerStreamIDMatchesSynStream(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	ids := make(chan framing.StreamId, 1)
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := StreamID(r.Context())
+		if !ok {
+			t.Error("no stream id in request context")
+		}
+		ids <- id
+	}), sconn)
+
+	fr := framing.NewFramer(cconn, cconn)
+	err := fr.WriteFrame(&framing.SynStreamFrame{
+		StreamId: 7,
+		Headers: http.Header{
+			":scheme":  {"http"},
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+		},
+		CFHeader: framing.ControlFrameHeader{Flags: framing.ControlFlagFin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := f.(*framing.SynReplyFrame); !ok || f.StreamId != 7 {
+		t.Fatalf("got %s want SYN_REPLY on stream 7", framing.DumpFrame(f))
+	}
+	if id := <-ids; id != 7 {
+		t.Errorf("StreamID = %d want 7", id)
+	}
+}
+
+func TestServerServeConnAuto(t *testing.T) {
+	srv := &Server{Server: http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		}),
+	}}
+	serve := func() net.Conn {
+		// net.Pipe, since net/http sets deadlines.
+		cconn, sconn := net.Pipe()
+		go func() {
+			if err := srv.ServeConnAuto(sconn); err != nil {
+				t.Error("server unexpected err", err)
+			}
+		}()
+		return cconn
+	}
+
+	cconn := serve()
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	cconn.Close()
+	if !IsSPDY(resp) || string(b) != "HTTP/1.1" {
+		t.Errorf("SPDY client got %q, IsSPDY = %v", b, IsSPDY(resp))
+	}
+
+	cconn = serve()
+	defer cconn.Close()
+	io.WriteString(cconn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(cconn), nil)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(b) != "HTTP/1.1" {
+		t.Errorf("HTTP/1.1 client got %s %q", resp.Status, b)
+	}
+}
+
+func TestServerVirtualHosts(t *testing.T) {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		})
+	}
+	mux := http.NewServeMux()
+	mux.Handle("a.example/", named("mux a"))
+	mux.Handle("b.example/", named("mux b"))
+	srv := &Server{
+		Server: http.Server{Handler: mux},
+		Handlers: map[string]http.Handler{
+			"c.example":      named("c"),
+			"d.example:8080": named("d"),
+		},
+	}
+	cconn, sconn := pipeConn()
+	go srv.ServeConn(sconn)
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://a.example/", "mux a"},
+		{"http://b.example/", "mux b"},
+		{"http://C.example:8443/", "c"},
+		{"http://d.example:8080/", "d"},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(tt.url)
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tt.want {
+			t.Errorf("GET %s = %q want %q", tt.url, b, tt.want)
+		}
+	}
+}
+
+func TestStreamIDNotSPDY(t *testing.T) {
+	if id, ok := StreamID(context.Background()); id != 0 || ok {
+		t.Errorf("StreamID = %d, %v want 0, false", id, ok)
+	}
+}
+
+func TestIsSPDY(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), sconn)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := (&Conn{Conn: cconn}).RoundTrip(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if !IsSPDY(resp) {
+		t.Error("IsSPDY = false for a response from Conn")
+	}
+	if st := ResponseStream(resp); st == nil || st.Id() != 1 {
+		t.Errorf("ResponseStream = %v want stream 1", st)
+	}
+	if resp.Request != req {
+		t.Error("resp.Request isn't the request passed to RoundTrip")
+	}
+
+	// As from a RoundTripper that fell back to HTTP/1.1.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	resp, err = http.Get(ts.URL)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if IsSPDY(resp) {
+		t.Error("IsSPDY = true for an HTTP/1.1 response")
+	}
+}
+
+func TestServerSessionRemoteAddr(t *testing.T) {
+	cconn, sconn := pipeConn()
+	sconn = addrConn{sconn, stringAddr("192.0.2.1:1234")}
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := r.Context().Value(StreamContextKey).(*framing.Stream)
+		a := st.Session().RemoteAddr()
+		if a == nil || a.String() != "192.0.2.1:1234" {
+			t.Errorf("RemoteAddr = %v want 192.0.2.1:1234", a)
+		}
+	}), sconn)
+
+	resp, err := (&http.Client{Transport: &Conn{Conn: cconn}}).Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+}
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestServerKeepPseudoHeaders(t *testing.T) {
+	cconn, sconn := pipeConn()
+	s := &Server{KeepPseudoHeaders: true}
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := map[string]string{
+			"X-Spdy-Scheme": "https",
+			"X-Spdy-Host":   "example.com",
+			"X-Spdy-Path":   "/a?b",
+			"X-Spdy-Method": "GET",
+		}
+		for k, v := range want {
+			if g := r.Header.Get(k); g != v {
+				t.Errorf("%s = %q want %q", k, g, v)
+			}
+		}
+		if g := r.Header.Get("X-Spdy-Fake"); g != "" {
+			t.Errorf("X-Spdy-Fake = %q want empty", g)
+		}
+	})
+	go s.ServeConn(sconn)
+
+	req, _ := http.NewRequest("GET", "https://example.com/a?b", nil)
+	req.Header.Set("X-Spdy-Fake", "1")
+	resp, err := (&Conn{Conn: cconn}).RoundTrip(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+}
+
+func TestServerAllowedMethods(t *testing.T) {
+	cconn, sconn := pipeConn()
+	s := &Server{AllowedMethods: []string{"GET", "OPTIONS"}}
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "OPTIONS" {
+			t.Errorf("handler called for %s", r.Method)
+		}
+	})
+	go s.ServeConn(sconn)
+
+	conn := &Conn{Conn: cconn}
+	tests := []struct {
+		method string
+		code   int
+		allow  string
+	}{
+		{"GET", 200, ""},
+		{"OPTIONS", 200, ""},
+		{"POST", 405, "GET, OPTIONS"},
+		{"TRACE", 405, "GET, OPTIONS"},
+		{"get", 405, "GET, OPTIONS"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://example.com/", nil)
+		resp, err := conn.RoundTrip(req)
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s: StatusCode = %d want %d", test.method, resp.StatusCode, test.code)
+		}
+		if g := resp.Header.Get("Allow"); g != test.allow {
+			t.Errorf("%s: Allow = %q want %q", test.method, g, test.allow)
+		}
+	}
+}
+
+func TestServerModifyRequest(t *testing.T) {
+	cconn, sconn := pipeConn()
+	s := &Server{ModifyRequest: func(r *http.Request) {
+		if a := r.Header.Get("X-Forwarded-For"); a != "" {
+			r.RemoteAddr = a
+		}
+	}}
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RemoteAddr != "192.0.2.1" {
+			t.Errorf("RemoteAddr = %q want %q", r.RemoteAddr, "192.0.2.1")
+		}
+	})
+	go s.ServeConn(sconn)
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	resp, err := (&Conn{Conn: cconn}).RoundTrip(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+}
+
+func TestConnReady(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, echoHandler(t), sconn)
+	conn := &Conn{Conn: cconn}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := conn.Ready(ctx); err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	sconn.Close()
+	if err := conn.Ready(ctx); err == nil {
+		t.Fatal("Ready on closed conn err = nil")
+	}
+}
+
+func TestServerBodyAfterLargeHeader(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, echoHandler(t), sconn)
+
+	body := strings.Repeat("x", 10000)
+	req, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader(body))
+	for i := 0; i < 200; i++ {
+		req.Header.Set(fmt.Sprintf("X-Pad-%d", i), strings.Repeat("y", 100))
+	}
+	h, _, err := RequestFramingHeader(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Send the request body right behind the header block,
+	// before the server could possibly have read the request.
+	fr := framing.NewFramer(cconn, cconn)
+	frames := []framing.Frame{
+		&framing.SynStreamFrame{StreamId: 1, Headers: h},
+		&framing.DataFrame{StreamId: 1, Data: []byte(body[:5000])},
+		&framing.DataFrame{StreamId: 1, Data: []byte(body[5000:]), Flags: framing.DataFlagFin},
+	}
+	for _, f := range frames {
+		if err := fr.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []byte
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f, ok := f.(*framing.DataFrame); ok {
+			got = append(got, f.Data...)
+			if f.Flags&framing.DataFlagFin != 0 {
+				break
+			}
+		}
+	}
+	if string(got) != body {
+		t.Errorf("echoed %d bytes want %d", len(got), len(body))
+	}
+}
+
+func TestServerBadRequestHeader(t *testing.T) {
+	tests := []struct {
+		h         http.Header
+		wantReply bool // want 400 (else RST_STREAM with PROTOCOL_ERROR)
+	}{
+		{http.Header{":scheme": {"http"}, ":method": {"GET"}, ":version": {"HTTP/1.1"}}, false},
+		{http.Header{":scheme": {"http"}, ":method": {"GET"}, ":path": {"x"}, ":version": {"HTTP/1.1"}}, false},
+		{http.Header{":scheme": {"http"}, ":method": {"GET"}, ":path": {"/"}, ":version": {"SPDY"}}, false},
+		{http.Header{":scheme": {"ftp"}, ":method": {"GET"}, ":path": {"/"}, ":version": {"HTTP/1.1"}}, false},
+		{http.Header{
+			":scheme":        {"http"},
+			":method":        {"POST"},
+			":path":          {"/"},
+			":version":       {"HTTP/1.1"},
+			"Content-Length": {"x"},
+		}, true},
+	}
+	for i, tt := range tests {
+		cconn, sconn := pipeConn()
+		go serveConn(t, echoHandler(t), sconn)
+		fr := framing.NewFramer(cconn, cconn)
+		err := fr.WriteFrame(&framing.SynStreamFrame{
+			StreamId: 1,
+			Headers:  tt.h,
+			CFHeader: framing.ControlFrameHeader{Flags: framing.ControlFlagFin},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *framing.SynReplyFrame:
+			if !tt.wantReply {
+				t.Errorf("#%d: got SYN_REPLY %v want RST_STREAM", i, f.Headers)
+			} else if g := f.Headers.Get(":status"); g != "400" {
+				t.Errorf("#%d: :status = %q want 400", i, g)
+			}
+		case *framing.RstStreamFrame:
+			if tt.wantReply || f.Status != framing.ProtocolError {
+				t.Errorf("#%d: got RST_STREAM %d", i, f.Status)
+			}
+		default:
+			t.Errorf("#%d: got %s", i, framing.DumpFrame(f))
+		}
+		cconn.Close()
+	}
+}
+
+func TestServerAbort(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	closed := make(chan bool, 1)
+	s := &Server{StreamState: func(st *framing.Stream, state StreamState) {
+		if state == StreamClosed {
+			closed <- true
+		}
+	}}
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(Aborter).Abort(framing.FlowControlError)
+		if _, err := io.WriteString(w, "more"); err == nil {
+			t.Error("Write succeeded after Abort")
+		}
+	})
+	go s.ServeConn(sconn)
+
+	fr := framing.NewFramer(cconn, cconn)
+	err := fr.WriteFrame(&framing.SynStreamFrame{
+		StreamId: 1,
+		Headers: http.Header{
+			":scheme":  {"http"},
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+		},
+		CFHeader: framing.ControlFrameHeader{Flags: framing.ControlFlagFin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() framing.Frame {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	if f, ok := next().(*framing.SynReplyFrame); !ok {
+		t.Fatalf("got %s want SYN_REPLY", framing.DumpFrame(f))
+	}
+	if f, ok := next().(*framing.DataFrame); !ok || string(f.Data) != "partial" {
+		t.Fatalf("got %s want DATA %q", framing.DumpFrame(f), "partial")
+	}
+	f := next()
+	if f, ok := f.(*framing.RstStreamFrame); !ok || f.Status != framing.FlowControlError {
+		t.Fatalf("got %s want RST_STREAM with FLOW_CONTROL_ERROR", framing.DumpFrame(f))
+	}
+	// Once the handler is done, nothing more on the stream,
+	// such as FLAG_FIN, comes before the answer to this PING.
+	<-closed
+	if err := fr.WriteFrame(&framing.PingFrame{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if f := next(); !isPing(f) {
+		t.Errorf("got %s want PING", framing.DumpFrame(f))
+	}
+}
+
+// Abort interrupts a Write that is waiting for the client
+// to open its flow control window.
+func TestServerAbortBlockedWrite(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	full := make(chan bool)
+	aborted := make(chan error)
+	s := &Server{}
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		werr := make(chan error, 1)
+		go func() {
+			_, err := w.Write(make([]byte, 1<<20))
+			werr <- err
+		}()
+		<-full
+		w.(Aborter).Abort(framing.Cancel)
+		aborted <- <-werr
+	})
+	go s.ServeConn(sconn)
+
+	fr := framing.NewFramer(cconn, cconn)
+	err := fr.WriteFrame(&framing.SynStreamFrame{
+		StreamId: 1,
+		Headers: http.Header{
+			":scheme":  {"http"},
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+		},
+		CFHeader: framing.ControlFrameHeader{Flags: framing.ControlFlagFin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read everything, but never send WINDOW_UPDATE.
+	go func() {
+		n := 0
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f, ok := f.(*framing.DataFrame); ok {
+				n += len(f.Data)
+				if n == 64*1024 {
+					close(full)
+				}
+			}
+		}
+	}()
+	select {
+	case err := <-aborted:
+		if err == nil {
+			t.Error("Write succeeded after Abort")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Abort or Write still blocked")
+	}
+}
+
+// A client reading an aborted response gets an error,
+// not a clean but truncated body.
+func TestConnAbortedResponse(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(Aborter).Abort(framing.InternalError)
+	}), sconn)
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("read %q with no error from an aborted response", b)
+	}
+}
+
+// A request the server refuses before replying fails with
+// an error that says why, not just that the stream closed.
+func TestConnRefusedRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame framing.Frame
+		check func(error) bool
+	}{
+		{
+			"GoAway",
+			&framing.GoAwayFrame{LastGoodStreamId: 0},
+			func(err error) bool { return err == framing.ErrGoingAway },
+		},
+		{
+			"RefusedStream",
+			&framing.RstStreamFrame{StreamId: 1, Status: framing.RefusedStream},
+			func(err error) bool {
+				status, ok := framing.ResetStatus(err)
+				return ok && status == framing.RefusedStream
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cconn, sconn := pipeConn()
+			defer cconn.Close()
+			go func() {
+				fr := framing.NewFramer(sconn, sconn)
+				if _, err := fr.ReadFrame(); err != nil {
+					t.Error(err)
+					return
+				}
+				fr.WriteFrame(tt.frame)
+			}()
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			_, err := (&Conn{Conn: cconn}).RoundTrip(req)
+			if !tt.check(err) {
+				t.Errorf("RoundTrip err = %v", err)
+			}
+		})
+	}
+}
+
+// A handler that ignores the request body doesn't leave
+// the client waiting for window to send the rest of it.
+func TestServerUnreadBody(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body.Close()
+	}), sconn)
+
+	fr := framing.NewFramer(cconn, cconn)
+	err := fr.WriteFrame(&framing.SynStreamFrame{
+		StreamId: 1,
+		Headers: http.Header{
+			":scheme":  {"http"},
+			":method":  {"POST"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A whole window's worth, so the client can send
+	// no more without WINDOW_UPDATE.
+	err = fr.WriteFrame(&framing.DataFrame{StreamId: 1, Data: make([]byte, 64*1024)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The dropped body is credited with WINDOW_UPDATE,
+	// which can come at any point; skip it.
+	next := func() framing.Frame {
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := f.(*framing.WindowUpdateFrame); !ok {
+				return f
+			}
+		}
+	}
+	if f, ok := next().(*framing.SynReplyFrame); !ok || f.CFHeader.Flags&framing.ControlFlagFin == 0 {
+		t.Fatalf("got %s want SYN_REPLY with FLAG_FIN", framing.DumpFrame(f))
+	}
+	f := next()
+	if f, ok := f.(*framing.RstStreamFrame); !ok || f.Status != framing.Cancel {
+		t.Fatalf("got %s want RST_STREAM with CANCEL", framing.DumpFrame(f))
+	}
+}
+
+// A handler whose stream the client resets before it
+// replies sends nothing more once it returns.
+func TestServerHandlerAfterReset(t *testing.T) {
+	handlers := []struct {
+		name string
+		h    http.HandlerFunc
+	}{
+		{"Empty", func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}},
+		{"Write", func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			io.WriteString(w, "late")
+		}},
+		{"Trailer", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Status")
+			<-r.Context().Done()
+			w.Header().Set("X-Status", "late")
+		}},
+	}
+	for _, tt := range handlers {
+		t.Run(tt.name, func(t *testing.T) {
+			cconn, sconn := pipeConn()
+			defer cconn.Close()
+			closed := make(chan bool, 1)
+			srv := &Server{StreamState: func(st *framing.Stream, state StreamState) {
+				if state == StreamClosed {
+					closed <- true
+				}
+			}}
+			srv.Handler = tt.h
+			go srv.ServeConn(sconn)
+
+			fr := framing.NewFramer(cconn, cconn)
+			frames := make(chan framing.Frame, 10)
+			go func() {
+				defer close(frames)
+				for {
+					f, err := fr.ReadFrame()
+					if err != nil {
+						return
+					}
+					frames <- f
+				}
+			}()
+			syn := &framing.SynStreamFrame{
+				StreamId: 1,
+				Headers: http.Header{
+					":scheme":  {"http"},
+					":method":  {"GET"},
+					":path":    {"/"},
+					":version": {"HTTP/1.1"},
+				},
+			}
+			syn.CFHeader.Flags = framing.ControlFlagFin
+			for _, f := range []framing.Frame{
+				syn,
+				&framing.RstStreamFrame{StreamId: 1, Status: framing.Cancel},
+			} {
+				if err := fr.WriteFrame(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler didn't finish after RST_STREAM")
+			}
+			if err := fr.WriteFrame(&framing.PingFrame{Id: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if f := <-frames; !isPing(f) {
+				t.Errorf("got %s want PING", framing.DumpFrame(f))
+			}
+		})
+	}
+}
+
+func TestServerInitialReceiveWindow(t *testing.T) {
+	const n = 512 * 1024
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	release := make(chan bool)
+	srv := &Server{InitialReceiveWindow: n}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil || len(b) != n {
+			t.Errorf("read %d bytes, err %v want %d bytes", len(b), err, n)
+		}
+	})
+	go srv.ServeConn(sconn)
+
+	conn := &Conn{Conn: cconn}
+	// Wait for the server's SETTINGS.
+	if err := conn.Ready(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", "http://example.com/", nil)
+	body, resp, err := conn.OpenRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The whole body fits in the window,
+	// though the handler isn't reading yet.
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := body.Write(make([]byte, n))
+		body.Close()
+		wrote <- err
+	}()
+	select {
+	case err := <-wrote:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload stuck; window not enlarged")
+	}
+	close(release)
+	res, err := resp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
+
+func TestServerHeaderCompressionLevel(t *testing.T) {
+	for _, level := range []int{zlib.BestSpeed, zlib.NoCompression} {
+		level := level
+		cconn, sconn := pipeConn()
+		srv := &Server{HeaderCompressionLevel: &level}
+		srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Echo", r.Header.Get("X-Test"))
+		})
+		go srv.ServeConn(sconn)
+
+		conn := &Conn{Conn: cconn, HeaderCompressionLevel: &level}
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			req.Header.Set("X-Test", strconv.Itoa(i))
+			resp, err := conn.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("level %d: unexpected err %v", level, err)
+			}
+			resp.Body.Close()
+			if g, w := resp.Header.Get("X-Echo"), strconv.Itoa(i); g != w {
+				t.Errorf("level %d #%d: X-Echo = %q want %q", level, i, g, w)
+			}
+		}
+		cconn.Close()
+	}
+
+	bad := 42
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	srv := &Server{HeaderCompressionLevel: &bad}
+	if err := srv.ServeConn(sconn); err == nil {
+		t.Error("ServeConn succeeded with HeaderCompressionLevel 42")
+	}
+	conn := &Conn{Conn: cconn, HeaderCompressionLevel: &bad}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if _, err := conn.RoundTrip(req); err == nil {
+		t.Error("RoundTrip succeeded with HeaderCompressionLevel 42")
+	}
+}
+
+func TestServerRawHeaders(t *testing.T) {
+	cconn, sconn := pipeConn()
+	got := make(chan []framing.HeaderField, 1)
+	srv := &Server{RawHeaders: true}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := r.Context().Value(StreamContextKey).(*framing.Stream)
+		got <- st.RawHeader()
+	})
+	go srv.ServeConn(sconn)
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header["X-Signed"] = []string{"a", "b"}
+	resp, err := (&Conn{Conn: cconn}).RoundTrip(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	raw := <-got
+	if len(raw) == 0 || raw[0].Name != ":method" {
+		t.Fatalf("RawHeader = %q want :method first", raw)
+	}
+	want := framing.HeaderField{Name: "x-signed", Value: "a\x00b"}
+	for _, f := range raw {
+		if f == want {
+			return
+		}
+	}
+	t.Errorf("RawHeader = %q want it to have %q", raw, want)
+}
+
+func TestLogFrames(t *testing.T) {
+	var slog, clog lockedBuffer
+	cconn, sconn := pipeConn()
+	srv := &Server{LogFrames: true}
+	srv.ErrorLog = log.New(&slog, "", 0)
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	go srv.ServeConn(sconn)
+
+	conn := &Conn{Conn: cconn, LogFrames: true, ErrorLog: log.New(&clog, "", 0)}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := conn.RoundTrip(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for _, tt := range []struct {
+		name string
+		buf  *lockedBuffer
+		want []string
+	}{
+		{"client", &clog, []string{
+			"spdy: to |: SYN_STREAM stream=1 ",
+			"\t:method: GET\n",
+			"spdy: from |: SYN_REPLY stream=1 ",
+			"spdy: from |: DATA stream=1 flags=0x00 length=5\n",
+		}},
+		{"server", &slog, []string{
+			"spdy: from |: SYN_STREAM stream=1 ",
+			"spdy: to |: SYN_REPLY stream=1 ",
+			"spdy: to |: DATA stream=1 flags=0x00 length=5\n",
+		}},
+	} {
+		got := tt.buf.String()
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s log missing %q; got:\n%s", tt.name, w, got)
+			}
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that's safe
+// for concurrent use, for capturing logs.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestServerInitialReceiveWindowRange(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	srv := &Server{InitialReceiveWindow: -1}
+	if err := srv.ServeConn(sconn); err == nil {
+		t.Error("ServeConn succeeded with a negative InitialReceiveWindow")
+	}
+}
+
+// A body in several DATA frames, the last with FLAG_FIN,
+// and no trailer, reads to a clean EOF.
+func TestServerMultiFrameBody(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	got := make(chan string, 1)
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error("read body:", err)
+		}
+		if r.Trailer != nil {
+			t.Errorf("Trailer = %v want nil", r.Trailer)
+		}
+		got <- string(b)
+	}), sconn)
+
+	fr := framing.NewFramer(cconn, cconn)
+	frames := []framing.Frame{
+		&framing.SynStreamFrame{
+			StreamId: 1,
+			Headers: http.Header{
+				":scheme":  {"http"},
+				":method":  {"POST"},
+				":path":    {"/"},
+				":version": {"HTTP/1.1"},
+			},
+		},
+		&framing.DataFrame{StreamId: 1, Data: []byte("abc")},
+		&framing.DataFrame{StreamId: 1, Data: []byte("def")},
+		&framing.DataFrame{StreamId: 1, Data: []byte("ghi"), Flags: framing.DataFlagFin},
+	}
+	for _, f := range frames {
+		if err := fr.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case b := <-got:
+		if b != "abcdefghi" {
+			t.Errorf("body = %q want %q", b, "abcdefghi")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still reading body after FLAG_FIN")
+	}
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := f.(*framing.SynReplyFrame); !ok || f.CFHeader.Flags&framing.ControlFlagFin == 0 {
+		t.Errorf("got %s want SYN_REPLY with FLAG_FIN", framing.DumpFrame(f))
+	}
+}
+
+// With ResponseBufferSize set, writes share frames, Flush
+// sends what's buffered, and the tail of the body carries
+// FLAG_FIN with no empty DATA frame after it.
+func TestServerResponseBuffer(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	srv := &Server{ResponseBufferSize: 4096}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "a")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "b")
+		io.WriteString(w, "c")
+	})
+	go srv.ServeConn(sconn)
+
+	fr := framing.NewFramer(cconn, cconn)
+	err := fr.WriteFrame(&framing.SynStreamFrame{
+		StreamId: 1,
+		Headers: http.Header{
+			":scheme":  {"http"},
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+		},
+		CFHeader: framing.ControlFrameHeader{Flags: framing.ControlFlagFin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() framing.Frame {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	if f, ok := next().(*framing.SynReplyFrame); !ok {
+		t.Fatalf("got %s want SYN_REPLY", framing.DumpFrame(f))
+	}
+	want := []*framing.DataFrame{
+		{StreamId: 1, Data: []byte("a")},
+		{StreamId: 1, Data: []byte("bc"), Flags: framing.DataFlagFin},
+	}
+	for _, w := range want {
+		f := next()
+		if !reflect.DeepEqual(f, w) {
+			t.Fatalf("got %s want %s", framing.DumpFrame(f), framing.DumpFrame(w))
+		}
+	}
+	// Nothing more, such as an empty DATA frame,
+	// comes before the answer to this PING.
+	if err := fr.WriteFrame(&framing.PingFrame{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if f := next(); !isPing(f) {
+		t.Errorf("got %s want PING", framing.DumpFrame(f))
+	}
+}
+
+// A Flush that fails, because the client reset the stream,
+// is logged through ErrorLog.
+func TestServerFlushError(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	var logbuf bytes.Buffer
+	flushed := make(chan bool)
+	srv := &Server{ResponseBufferSize: 4096}
+	srv.ErrorLog = log.New(&logbuf, "", 0)
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "a")
+		<-r.Context().Done()
+		w.(http.Flusher).Flush()
+		close(flushed)
+	})
+	go srv.ServeConn(sconn)
+
+	fr := framing.NewFramer(cconn, cconn)
+	err := fr.WriteFrame(&framing.SynStreamFrame{
+		StreamId: 1,
+		Headers: http.Header{
+			":scheme":  {"http"},
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+		},
+		CFHeader: framing.ControlFrameHeader{Flags: framing.ControlFlagFin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := fr.ReadFrame(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := f.(*framing.SynReplyFrame); !ok {
+		t.Fatalf("got %s want SYN_REPLY", framing.DumpFrame(f))
+	}
+	err = fr.WriteFrame(&framing.RstStreamFrame{StreamId: 1, Status: framing.Cancel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-flushed
+	if g := logbuf.String(); !strings.Contains(g, "flush") {
+		t.Errorf("log = %q want flush error", g)
+	}
+}
+
+// Run with -race. A goroutine that writes to a response
+// after its handler has returned gets an error, and the
+// write doesn't reach the connection.
+func TestServerWriteAfterHandler(t *testing.T) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	returned := make(chan bool)
+	late := make(chan error, 3)
+	srv := &Server{StreamState: func(st *framing.Stream, state StreamState) {
+		if state == StreamClosed && st.Id() == 1 {
+			close(returned)
+		}
+	}}
+	srv.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/late" {
+			io.WriteString(w, "ok")
+			return
+		}
+		io.WriteString(w, "early")
+		go func() {
+			<-returned
+			_, err := io.WriteString(w, "late")
+			late <- err
+			w.WriteHeader(500)
+			w.(http.Flusher).Flush()
+			late <- nil
+		}()
+	})
+	go srv.ServeConn(sconn)
+
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	get := func(path string) string {
+		resp, err := client.Get("http://example.com" + path)
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		return string(b)
+	}
+	if g := get("/late"); g != "early" {
+		t.Errorf("late body = %q want %q", g, "early")
+	}
+	if err := <-late; err == nil {
+		t.Error("write after the handler returned succeeded")
+	}
+	<-late
+	if g := get("/ok"); g != "ok" {
+		t.Errorf("next body = %q want %q", g, "ok")
+	}
+}
+
+func isPing(f framing.Frame) bool {
+	_, ok := f.(*framing.PingFrame)
+	return ok
+}
+
+func TestServerCloseRead(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := w.(interface{ CloseRead() error }).CloseRead(); err != nil {
+			t.Error(err)
+		}
+		if _, err := r.Body.Read(make([]byte, 1)); err == nil {
+			t.Error("body read succeeded after CloseRead")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+		}
+	}), sconn)
+
+	// The client keeps sending; the server drops it.
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 10; i++ {
+			pw.Write([]byte("ignored"))
+		}
+		pw.Close()
+	}()
+	req, _ := http.NewRequest("POST", "http://example.com/", pr)
+	resp, err := (&Conn{Conn: cconn}).RoundTrip(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	want := "data: 0\n\ndata: 1\n\ndata: 2\n\n"
+	if string(b) != want {
+		t.Errorf("body = %q want %q", b, want)
+	}
+}
+
+func TestServerInterimResponse(t *testing.T) {
+	cconn, sconn := pipeConn()
+	go serveConn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.WriteHeader(http.StatusContinue)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "ok")
+	}), sconn)
+
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("StatusCode = %d want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if g := resp.Header.Get("Link"); g == "" {
+		t.Error("Link header missing from final response")
+	}
+	if string(b) != "ok" {
+		t.Errorf("Body = %q want %q", b, "ok")
+	}
+}
+
+type keepAliveConn struct {
+	*net.TCPConn
+	period time.Duration
+}
+
+func (c *keepAliveConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return c.TCPConn.SetKeepAlivePeriod(d)
+}
+
+func TestServerTCPKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, tt := range []struct{ set, want time.Duration }{
+		{0, defaultTCPKeepAlive},
+		{time.Minute, time.Minute},
+		{-1, 0},
+	} {
+		cc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &keepAliveConn{TCPConn: sc.(*net.TCPConn)}
+		s := &Server{TCPKeepAlive: tt.set}
+		done := make(chan bool)
+		go func() {
+			s.ServeConn(c)
+			close(done)
+		}()
+		cc.Close()
+		<-done
+		if c.period != tt.want {
+			t.Errorf("TCPKeepAlive %v: period = %v want %v", tt.set, c.period, tt.want)
+		}
+	}
+}
+
+func TestServerStates(t *testing.T) {
+	cconn, sconn := pipeConn()
+	var (
+		mu           sync.Mutex
+		connStates   []http.ConnState
+		streamStates []StreamState
+	)
+	idle := make(chan bool)
+	s := &Server{StreamState: func(st *framing.Stream, state StreamState) {
+		mu.Lock()
+		streamStates = append(streamStates, state)
+		mu.Unlock()
+	}}
+	s.ConnState = func(c net.Conn, state http.ConnState) {
+		mu.Lock()
+		connStates = append(connStates, state)
+		mu.Unlock()
+		if state == http.StateIdle {
+			idle <- true
+		}
+	}
+	s.Handler = echoHandler(t)
+	served := make(chan bool)
+	go func() {
+		s.ServeConn(sconn)
+		served <- true
+	}()
+
+	client := &http.Client{Transport: &Conn{Conn: cconn}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	<-idle
+	cconn.Close()
+	<-served
+
+	wantConn := []http.ConnState{http.StateNew, http.StateActive, http.StateIdle, http.StateClosed}
+	if !reflect.DeepEqual(connStates, wantConn) {
+		t.Errorf("conn states = %v want %v", connStates, wantConn)
+	}
+	wantStream := []StreamState{StreamNew, StreamActive, StreamClosed}
+	if !reflect.DeepEqual(streamStates, wantStream) {
+		t.Errorf("stream states = %v want %v", streamStates, wantStream)
+	}
+}
+
+// BenchmarkRoundTripSmall measures a tiny GET,
+// as in RPC-style use with many small calls.
+func BenchmarkRoundTripSmall(b *testing.B) {
+	cconn, sconn := pipeConn()
+	defer cconn.Close()
+	s := &Server{}
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		io.WriteString(w, "hello")
+	})
+	go s.ServeConn(sconn)
+	conn := &Conn{Conn: cconn}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	buf := make([]byte, 10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := conn.RoundTrip(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for err == nil {
+			_, err = resp.Body.Read(buf)
+		}
+		if err != io.EOF {
+			b.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+}
+
 type side struct {
 	*io.PipeReader
 	*io.PipeWriter
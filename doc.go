@@ -1,2 +1,10 @@
 // Package spdy implements the SPDY protocol's HTTP layer.
+//
+// Each SPDY stream carries a request and its response
+// independently, so unlike an HTTP/1.1 handler in net/http,
+// a handler here may write its response while it is still
+// reading the request body. Reading the body returns io.EOF
+// exactly when the client's FLAG_FIN arrives, so a handler can
+// stream both ways at once and still learn when the client
+// is done. On the client side, Conn.OpenRequest does the same.
 package spdy
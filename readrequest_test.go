@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -283,6 +284,123 @@ var reqTests = []reqTest{
 		noTrailer,
 		noError,
 	},
+
+	// OPTIONS request for the whole server:
+	{
+		http.Header{
+			":scheme":  {"http"},
+			":method":  {"OPTIONS"},
+			":path":    {"*"},
+			":host":    {"www.google.com"},
+			":version": {"HTTP/1.1"},
+		},
+		noBody,
+		noTrailer,
+
+		&http.Request{
+			Method: "OPTIONS",
+			URL: &url.URL{
+				Scheme: "http",
+				Host:   "www.google.com",
+				Path:   "*",
+			},
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			Close:         true,
+			ContentLength: -1,
+			Host:          "www.google.com",
+			RequestURI:    "",
+		},
+
+		noBody,
+		noTrailer,
+		noError,
+	},
+
+	// Only OPTIONS may use *:
+	{
+		http.Header{
+			":scheme":  {"http"},
+			":method":  {"GET"},
+			":path":    {"*"},
+			":host":    {"www.google.com"},
+			":version": {"HTTP/1.1"},
+		},
+		noBody,
+		noTrailer,
+		nil,
+		noBody,
+		noTrailer,
+		"invalid path: *",
+	},
+
+	// :scheme is case-insensitive
+	{
+		http.Header{
+			":scheme":  {"HTTPS"},
+			":method":  {"GET"},
+			":path":    {"/"},
+			":host":    {"www.google.com"},
+			":version": {"HTTP/1.1"},
+		},
+		noBody,
+		noTrailer,
+
+		&http.Request{
+			Method: "GET",
+			URL: &url.URL{
+				Scheme: "https",
+				Host:   "www.google.com",
+				Path:   "/",
+			},
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Close:      true,
+			Host:       "www.google.com",
+			RequestURI: "",
+		},
+
+		noBody,
+		noTrailer,
+		noError,
+	},
+
+	// Only http and https are allowed
+	{
+		http.Header{
+			":scheme":  {"ftp"},
+			":method":  {"GET"},
+			":path":    {"/"},
+			":host":    {"www.google.com"},
+			":version": {"HTTP/1.1"},
+		},
+		noBody,
+		noTrailer,
+		nil,
+		noBody,
+		noTrailer,
+		"invalid scheme: ftp",
+	},
+
+	// :scheme is required
+	{
+		http.Header{
+			":method":  {"GET"},
+			":path":    {"/"},
+			":host":    {"www.google.com"},
+			":version": {"HTTP/1.1"},
+		},
+		noBody,
+		noTrailer,
+		nil,
+		noBody,
+		noTrailer,
+		"invalid scheme: ",
+	},
 }
 
 func TestNewRequest(t *testing.T) {
@@ -327,6 +445,62 @@ func TestNewRequest(t *testing.T) {
 	}
 }
 
+var bodyLengthTests = []struct {
+	cl   string
+	body string
+	err  error
+}{
+	{"3", "abc", nil},
+	{"0", "", nil},
+	{"10", "abc", io.ErrUnexpectedEOF},
+	{"3", "abcdef", errBodyTooLong},
+	{"0", "a", errBodyTooLong},
+}
+
+func TestReadRequestBodyLength(t *testing.T) {
+	for i, tt := range bodyLengthTests {
+		h := http.Header{
+			":scheme":        {"http"},
+			":method":        {"POST"},
+			":path":          {"/"},
+			":host":          {"foo.com"},
+			":version":       {"HTTP/1.1"},
+			"Content-Length": {tt.cl},
+		}
+		req, err := ReadRequest(h, nil, strings.NewReader(tt.body))
+		if err != nil {
+			t.Errorf("#%d: unexpected err %v", i, err)
+			continue
+		}
+		_, err = ioutil.ReadAll(req.Body)
+		if err != tt.err {
+			t.Errorf("#%d: err = %v want %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestPseudoHeaders(t *testing.T) {
+	h := http.Header{
+		":method":    {"GET"},
+		":path":      {"/"},
+		":x-custom":  {"a", "b"},
+		"User-Agent": {"Go"},
+	}
+	got := PseudoHeaders(h)
+	want := http.Header{
+		":method":   {"GET"},
+		":path":     {"/"},
+		":x-custom": {"a", "b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PseudoHeaders = %v want %v", got, want)
+	}
+	got[":path"][0] = "/changed"
+	if h.Get(":path") != "/" {
+		t.Error("PseudoHeaders shares values with its argument")
+	}
+}
+
 func diff(t *testing.T, prefix string, have, want interface{}) {
 	hv := reflect.ValueOf(have).Elem()
 	wv := reflect.ValueOf(want).Elem()
@@ -334,6 +508,9 @@ func diff(t *testing.T, prefix string, have, want interface{}) {
 		t.Errorf("%s: type mismatch %v want %v", prefix, hv.Type(), wv.Type())
 	}
 	for i := 0; i < hv.NumField(); i++ {
+		if !hv.Field(i).CanInterface() {
+			continue
+		}
 		hf := hv.Field(i).Interface()
 		wf := wv.Field(i).Interface()
 		if !reflect.DeepEqual(hf, wf) {
@@ -1,7 +1,6 @@
 package spdy
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -22,13 +21,21 @@ func ReadRequest(h, t http.Header, r io.Reader) (*http.Request, error) {
 	copyHeader(req.Header, h)
 	path := h.Get(":path")
 	if path == "" {
-		return nil, errors.New("missing path")
+		return nil, headerError("missing path")
 	}
-	if path[0] != '/' {
-		return nil, errors.New("invalid path: " + path)
+	// OPTIONS * asks about the server as a whole.
+	// See RFC 7230 section 5.3.4.
+	if path[0] != '/' && !(path == "*" && h.Get(":method") == "OPTIONS") {
+		return nil, headerError("invalid path: " + path)
+	}
+	// Only http and https make sense here.
+	// See SPDY/3 section 3.2.1.
+	scheme := strings.ToLower(h.Get(":scheme"))
+	if scheme != "http" && scheme != "https" {
+		return nil, headerError("invalid scheme: " + h.Get(":scheme"))
 	}
 	req.URL = &url.URL{
-		Scheme: h.Get(":scheme"),
+		Scheme: scheme,
 		Path:   path,
 		Host:   h.Get(":host"),
 	}
@@ -38,7 +45,7 @@ func ReadRequest(h, t http.Header, r io.Reader) (*http.Request, error) {
 	req.Proto = h.Get(":version")
 	var ok bool
 	if req.ProtoMajor, req.ProtoMinor, ok = http.ParseHTTPVersion(req.Proto); !ok {
-		return nil, errors.New("bad http version: " + req.Proto)
+		return nil, headerError("bad http version: " + req.Proto)
 	}
 	req.Header.Del("Host")
 
@@ -57,9 +64,10 @@ func ReadRequest(h, t http.Header, r io.Reader) (*http.Request, error) {
 		req.Header.Del("Content-Length")
 	}
 
-	// TODO(kr): content length / limit reader?
 	if r == nil {
 		r = eofReader
+	} else if cl != "" {
+		r = &lengthReader{r: r, n: req.ContentLength}
 	}
 	if t != nil {
 		req.Body = &body{r: r, hdr: req, trailer: t}
@@ -69,50 +77,86 @@ func ReadRequest(h, t http.Header, r io.Reader) (*http.Request, error) {
 	return req, nil
 }
 
+// A headerError reports a request header block that breaks
+// the rules of SPDY/3 itself, such as one with a missing or
+// malformed ':' field. See SPDY/3 section 3.2.1.
+type headerError string
+
+func (e headerError) Error() string { return string(e) }
+
 // RequestFramingHeader copies r into a header suitable for use in the SPDY
 // framing layer. It includes the SPDY-specific ':' fields such as :scheme,
 // :method, and :version.
+//
+// SPDY forbids Transfer-Encoding, so it is dropped, along with
+// r.TransferEncoding. A body of unknown length, such as one the
+// caller meant to send chunked, needs no framing of its own: it
+// is sent in DATA frames, and FLAG_FIN marks its end.
 func RequestFramingHeader(r *http.Request) (http.Header, framing.ControlFlags, error) {
 	if r.ContentLength > 0 && r.Body == nil {
 		return nil, 0, fmt.Errorf("http: Request.ContentLength=%d with nil Body", r.ContentLength)
 	}
-	h := make(http.Header)
-	for k, vv := range r.Header {
-		if len(k) > 0 && k[0] != ':' && len(vv) > 0 {
-			h[k] = vv
-		}
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
 	}
+	h := pushHeader(r.URL.Scheme, host, r.URL.RequestURI(), r.Header)
 	if _, ok := h["User-Agent"]; !ok {
 		h.Set("User-Agent", "github.com/kr/spdy")
 	}
 	h.Set(":method", r.Method)
-	h.Set(":path", r.URL.RequestURI())
-	scheme := r.URL.Scheme
-	if scheme == "" {
-		scheme = "http"
-	}
-	h.Set(":scheme", scheme)
-	host := r.Host
-	if host == "" {
-		host = r.URL.Host
-	}
-	h.Set(":host", host)
-	proto := r.Proto
-	if proto == "" {
-		proto = "HTTP/1.1"
+	if r.Proto != "" {
+		h.Set(":version", r.Proto)
 	}
-	h.Set(":version", proto)
 	if r.ContentLength > 0 {
 		h.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
 	} else if r.Method == "POST" && r.Body == nil {
 		h.Set("Content-Length", "0")
 	}
-	for _, s := range badReqHeaderFields {
-		delete(h, s)
-	}
 	var flag framing.ControlFlags
 	if r.Body == nil {
 		flag = framing.ControlFlagFin
 	}
 	return h, flag, nil
 }
+
+// pushHeader returns a header block for a GET request of
+// path on host, suitable for the SYN_STREAM of a pushed
+// resource. It has the SPDY-specific ':' fields, plus
+// the fields of extra that SPDY permits in a request.
+// If scheme is empty, it uses http.
+func pushHeader(scheme, host, path string, extra http.Header) http.Header {
+	h := make(http.Header)
+	for k, vv := range extra {
+		if len(k) > 0 && k[0] != ':' && len(vv) > 0 {
+			h[k] = vv
+		}
+	}
+	for _, s := range badReqHeaderFields {
+		delete(h, s)
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	h.Set(":method", "GET")
+	h.Set(":path", path)
+	h.Set(":scheme", scheme)
+	h.Set(":host", host)
+	h.Set(":version", "HTTP/1.1")
+	return h
+}
+
+// PseudoHeaders returns a new header containing only the
+// SPDY-specific fields of h, those starting with ':'.
+// ReadRequest and ReadResponse drop these fields, so a proxy
+// forwarding between two SPDY connections can use PseudoHeaders
+// on the original header block to pass them on faithfully.
+func PseudoHeaders(h http.Header) http.Header {
+	ph := make(http.Header)
+	for k, vv := range h {
+		if len(k) > 0 && k[0] == ':' {
+			ph[k] = append([]string(nil), vv...)
+		}
+	}
+	return ph
+}
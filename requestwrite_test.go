@@ -424,6 +424,29 @@ func TestRequestWrite(t *testing.T) {
 	}
 }
 
+func TestPushHeader(t *testing.T) {
+	extra := http.Header{
+		"Accept":     {"text/css"},
+		"Connection": {"close"},
+		":status":    {"200"},
+	}
+	g := pushHeader("https", "example.com", "/style.css", extra)
+	w := http.Header{
+		":method":  {"GET"},
+		":path":    {"/style.css"},
+		":scheme":  {"https"},
+		":host":    {"example.com"},
+		":version": {"HTTP/1.1"},
+		"Accept":   {"text/css"},
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("pushHeader = %v want %v", g, w)
+	}
+	if g := pushHeader("", "example.com", "/", nil).Get(":scheme"); g != "http" {
+		t.Errorf(":scheme = %q want %q", g, "http")
+	}
+}
+
 func mustParseURL(s string) *url.URL {
 	u, err := url.Parse(s)
 	if err != nil {
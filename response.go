@@ -5,12 +5,19 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+
+	framing "github.com/kr/spdy/spdyframing"
 )
 
 // ReadResponse reads an HTTP response. The header is taken from h,
 // which must include the SPDY-specific fields starting with ':'.
 // If r is not nil, the body will be read from r. If t is not nil,
 // the trailer will be taken from t after the body is finished.
+//
+// If the response has a Content-Length, the body returns
+// io.ErrUnexpectedEOF if r ends early, and stops after that many
+// bytes if r holds more. In the latter case, if r is a
+// *framing.Stream, it is reset with ProtocolError.
 func ReadResponse(h, t http.Header, r io.Reader, req *http.Request) (*http.Response, error) {
 	for _, s := range badRespHeaderFields {
 		if _, ok := h[s]; ok {
@@ -56,13 +63,23 @@ func ReadResponse(h, t http.Header, r io.Reader, req *http.Request) (*http.Respo
 	}
 
 	switch {
-	case realLength == 0:
+	case realLength == 0 && (t == nil || r == nil):
 		r = eofReader
-	case realLength > 0:
+	case realLength >= 0:
 		if r == nil {
 			// TODO(kr): return error
 		}
-		r = io.LimitReader(r, realLength)
+		// Read on to the end of the stream, so that the
+		// trailer, if any, is in place when the body ends.
+		// This holds for an empty body too: a trailers-only
+		// response ends with HEADERS, not DATA.
+		fr := &finReader{r: r, n: realLength}
+		if st, ok := r.(*framing.Stream); ok {
+			// More data than Content-Length is an error.
+			// Stop it with RST_STREAM.
+			fr.excess = func() { st.Reset(framing.ProtocolError) }
+		}
+		r = fr
 	}
 	if r == nil {
 		r = eofReader
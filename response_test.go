@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
@@ -320,6 +321,40 @@ func TestReadResponse(t *testing.T) {
 	}
 }
 
+var respBodyLengthTests = []struct {
+	cl   string
+	body string
+	want string
+	err  error
+}{
+	{"3", "abc", "abc", nil},
+	{"0", "", "", nil},
+	{"10", "abc", "abc", io.ErrUnexpectedEOF},
+	{"3", "abcdef", "abc", nil},
+}
+
+func TestReadResponseBodyLength(t *testing.T) {
+	for i, tt := range respBodyLengthTests {
+		h := http.Header{
+			":status":        {"200 OK"},
+			":version":       {"HTTP/1.1"},
+			"Content-Length": {tt.cl},
+		}
+		resp, err := ReadResponse(h, nil, strings.NewReader(tt.body), dummyReq("GET"))
+		if err != nil {
+			t.Errorf("#%d: unexpected err %v", i, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != tt.err {
+			t.Errorf("#%d: err = %v want %v", i, err, tt.err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("#%d: body = %q want %q", i, b, tt.want)
+		}
+	}
+}
+
 func TestResponseStatusStutter(t *testing.T) {
 	r := &response{}
 	h := r.framingHeader(123)
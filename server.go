@@ -1,16 +1,219 @@
 package spdy
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	framing "github.com/kr/spdy/spdyframing"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
 	http.Server
+
+	// ModifyResponseHeader, if non-nil, is called with the
+	// header block of every response just before it is sent,
+	// after the SPDY-specific ':' fields have been added.
+	// It may add, change, or delete fields.
+	ModifyResponseHeader func(http.Header)
+
+	// ModifyRequest, if non-nil, is called with every request
+	// just before it is passed to the handler, after RemoteAddr
+	// has been set from the connection. It may change the
+	// request, for example to set RemoteAddr from a header
+	// such as X-Forwarded-For supplied by a trusted proxy.
+	ModifyRequest func(*http.Request)
+
+	// AllowedMethods, if non-nil, lists the request methods
+	// the server accepts. A request with any other method gets
+	// 405 Method Not Allowed, with an Allow header listing
+	// AllowedMethods, and the handler is not called. Methods
+	// are case-sensitive. OPTIONS and CONNECT get no special
+	// treatment: list them to pass them to the handler.
+	// The check comes after ModifyRequest, so that can
+	// rewrite the method first. Nil allows all methods.
+	AllowedMethods []string
+
+	// Handlers, if non-nil, maps request hosts to handlers,
+	// for serving several virtual hosts over one connection.
+	// A request whose Host, with or without its port, matches
+	// a key goes to that handler; others go to Handler as usual.
+	// Keys must be lowercase. Host patterns in an http.ServeMux
+	// also work, since the request's Host comes from :host.
+	Handlers map[string]http.Handler
+
+	// KeepPseudoHeaders, if set, keeps the SPDY-specific ':'
+	// fields of each request, such as :scheme, in the request
+	// header under names with the prefix X-Spdy-, for example
+	// X-Spdy-Scheme. Any X-Spdy- fields sent by the client
+	// are removed first, so handlers can trust them.
+	// By default, the ':' fields are dropped.
+	KeepPseudoHeaders bool
+
+	// StrictHeaders makes the server reset, with PROTOCOL_ERROR,
+	// any request whose header block has a field name that
+	// isn't lowercase, as SPDY/3 requires. It is for catching
+	// nonconforming clients in interop testing. By default,
+	// such names are accepted.
+	StrictHeaders bool
+
+	// RawHeaders keeps each request's header block as the
+	// client sent it, with the fields in order, for middleware
+	// that checks request signatures. Get it with RawHeader on
+	// the stream under StreamContextKey. It's off by default,
+	// since it keeps a second copy of every request header.
+	RawHeaders bool
+
+	// LogFrames makes the server log, through ErrorLog, every
+	// frame it sends or receives, with the stream id and the
+	// header block in full but only the length of DATA. It is
+	// for debugging: it's verbose, and headers may carry
+	// cookies and credentials. It's off by default.
+	LogFrames bool
+
+	// StreamState specifies an optional callback function that is
+	// called when a stream changes state. See the StreamState type
+	// and associated constants for details.
+	//
+	// The ConnState callback of the embedded http.Server is called
+	// for the connection itself. It sees StateActive while the
+	// connection has streams in progress and StateIdle otherwise.
+	StreamState func(*framing.Stream, StreamState)
+
+	// ResponseBufferSize, if positive, is how much of each
+	// response body the server may hold back before sending
+	// it, so that small writes share DATA frames and the last
+	// of the body carries FLAG_FIN instead of an empty frame
+	// of its own. Handlers that stream, or that talk with the
+	// client in both directions at once, must then call Flush
+	// (see http.Flusher) to send what they've written so far.
+	// If zero, every write is sent right away.
+	ResponseBufferSize int
+
+	// WriteBufferSize and WriteFlushInterval configure
+	// buffering of outgoing frames on each connection.
+	// See the fields of the same name in framing.Session.
+	WriteBufferSize    int
+	WriteFlushInterval time.Duration
+
+	// MaxConcurrentStreams, if positive, limits how many
+	// requests are handled at once on each connection.
+	// Streams beyond the limit are refused before a handler
+	// goroutine is started for them, even if the client
+	// ignores any limit we advertise.
+	MaxConcurrentStreams int
+
+	// InitialReceiveWindow, if positive, is the flow control
+	// window for each request body, in bytes. The server
+	// advertises it to each client in SETTINGS and buffers
+	// that much per stream, so a larger window lets clients
+	// upload faster at the cost of memory. Values below the
+	// SPDY/3 default of 64 KiB are raised to it. It must be
+	// less than 1<<31. See framing.Session.ReceiveWindow.
+	InitialReceiveWindow int
+
+	// HeaderCompressionLevel, if non-nil, is the zlib level
+	// used to compress response header blocks, such as
+	// zlib.BestSpeed, or zlib.NoCompression to send them as
+	// they are. If nil, the default is zlib.BestCompression.
+	// An invalid level makes ServeConn return an error.
+	// See framing.Framer.SetCompressionLevel.
+	HeaderCompressionLevel *int
+
+	// WindowTimeout limits how long a response write waits
+	// for the client to open the stream's flow control window.
+	// See the field of the same name in framing.Session.
+	WindowTimeout time.Duration
+
+	// TCPKeepAlive is the keep-alive period set on each TCP
+	// connection, so that the operating system detects peers
+	// that have gone away without closing the connection.
+	// If zero, a default of 3 minutes is used.
+	// If negative, keep-alives are left as they are.
+	TCPKeepAlive time.Duration
+}
+
+const defaultTCPKeepAlive = 3 * time.Minute
+
+// StreamContextKey is a context key. It can be used in
+// handlers with Request.Context to access the
+// *framing.Stream carrying the request. It can be
+// used, for example, to get the header block size.
+// On the client side, see ResponseStream.
+var StreamContextKey = &contextKey{"spdy-stream"}
+
+// StreamID returns the id of the SPDY stream carrying the
+// request whose context is ctx, for correlating logs on
+// either side of a connection. It reports false if ctx
+// doesn't belong to a request served over SPDY, for
+// example one that net/http served over HTTP/1.1.
+func StreamID(ctx context.Context) (framing.StreamId, bool) {
+	st, ok := ctx.Value(StreamContextKey).(*framing.Stream)
+	if !ok {
+		return 0, false
+	}
+	return st.Id(), true
+}
+
+// Aborter is implemented by the http.ResponseWriter that
+// Server passes to handlers. A handler that can't finish
+// its response calls Abort to reset the stream with the
+// given status, such as framing.Cancel or
+// framing.InternalError, so that the client sees an error
+// instead of a truncated body:
+//
+//	if a, ok := w.(spdy.Aborter); ok {
+//		a.Abort(framing.InternalError)
+//	}
+type Aborter interface {
+	Abort(status framing.RstStreamStatus)
+}
+
+// contextKey is a value for use with context.WithValue.
+// It's used as a pointer so it fits in an interface{}
+// without allocation.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "spdy context value " + k.name }
+
+// A StreamState represents the state of a stream on the server.
+// It's used by the optional Server.StreamState hook.
+type StreamState int
+
+const (
+	// StreamNew represents a stream the client has just opened.
+	// Its request has not yet been read.
+	StreamNew StreamState = iota
+
+	// StreamActive represents a stream whose request has been
+	// read and is being served by the handler.
+	StreamActive
+
+	// StreamClosed represents a stream whose handler has
+	// returned. This is a terminal state.
+	StreamClosed
+)
+
+var streamStateName = map[StreamState]string{
+	StreamNew:    "new",
+	StreamActive: "active",
+	StreamClosed: "closed",
+}
+
+func (c StreamState) String() string {
+	return streamStateName[c]
 }
 
 // ListenAndServeTLS is like http.ListenAndServeTLS,
@@ -23,6 +226,21 @@ func ListenAndServeTLS(addr, certFile, keyFile string, h http.Handler) error {
 // ListenAndServeTLS is like http.Server.ListenAndServeTLS,
 // but serves both HTTP and SPDY.
 func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	s1 := s.tlsServer()
+	return s1.Server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ServeTLS is like http.Server.ServeTLS,
+// but serves both HTTP and SPDY.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	s1 := s.tlsServer()
+	return s1.Server.ServeTLS(l, certFile, keyFile)
+}
+
+// tlsServer returns a copy of s whose http.Server
+// offers spdy/3 in TLS negotiation and hands
+// connections that choose it to s.
+func (s *Server) tlsServer() *Server {
 	s1 := *s
 	s1.TLSConfig = new(tls.Config)
 	if s.TLSConfig != nil {
@@ -37,19 +255,24 @@ func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	if _, ok := s1.TLSNextProto["spdy/3"]; !ok {
 		s1.TLSNextProto["spdy/3"] = s.serveConn
 	}
-	return s1.Server.ListenAndServeTLS(certFile, keyFile)
+	return &s1
 }
 
 // Satisfy the signature of s.TLSNextProto.
 func (s *Server) serveConn(hs *http.Server, c *tls.Conn, h http.Handler) {
 	s1 := *s
 	if hs != nil {
-		s1.Server = *hs
+		// Take only the fields we use. Copying all of *hs
+		// would race with hs.Serve, which updates its state
+		// as connections come and go.
+		s1.Handler = hs.Handler
+		s1.ErrorLog = hs.ErrorLog
+		s1.ConnState = hs.ConnState
 	}
 	if h != nil {
 		s1.Server.Handler = h
 	}
-	err := s1.ServeConn(c)
+	err := s1.serve(c)
 	if err != nil {
 		log.Println("spdy:", err)
 	}
@@ -59,42 +282,305 @@ func (s *Server) serveConn(hs *http.Server, c *tls.Conn, h http.Handler) {
 // Most people don't need this; they should use
 // ListenAndServeTLS instead.
 func (s *Server) ServeConn(c net.Conn) error {
+	s.setState(c, http.StateNew)
+	defer s.setState(c, http.StateClosed)
+	return s.serve(c)
+}
+
+// ServeConnAuto serves c with SPDY or HTTP/1.1, whichever the
+// client speaks first. It is for plaintext connections, where
+// there's no TLS negotiation to pick the protocol, so that one
+// port can serve both. A SPDY client must start with a frame;
+// if the first bytes of c look like a SPDY/3 control frame,
+// c is served as in ServeConn. Otherwise, c is served by the
+// embedded http.Server. Either way, ServeConnAuto returns when
+// c is closed.
+func (s *Server) ServeConnAuto(c net.Conn) error {
+	s.setKeepAlive(c)
+	br := bufio.NewReader(c)
+	b, err := br.Peek(2)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	pc := &peekedConn{Conn: c, r: br, closed: make(chan struct{})}
+	if b[0] == 0x80 && b[1] == framing.Version {
+		return s.ServeConn(pc)
+	}
+	err = s.Server.Serve(&oneConnListener{c: pc, addr: c.LocalAddr()})
+	if err != io.EOF {
+		pc.Close()
+		return err
+	}
+	<-pc.closed
+	return nil
+}
+
+// peekedConn is a net.Conn whose first bytes have been
+// read into r, so reads must go through r.
+type peekedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	closed chan struct{} // closed by Close
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *peekedConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// oneConnListener is a net.Listener that returns
+// c from Accept once and then io.EOF.
+type oneConnListener struct {
+	mu   sync.Mutex
+	c    net.Conn
+	addr net.Addr
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.c
+	if c == nil {
+		return nil, io.EOF
+	}
+	l.c = nil
+	return c, nil
+}
+
+func (l *oneConnListener) Close() error { return nil }
+
+func (l *oneConnListener) Addr() net.Addr { return l.addr }
+
+// serve is ServeConn without the StateNew and StateClosed
+// transitions, for connections handed over by net/http,
+// which reports those itself.
+func (s *Server) serve(c net.Conn) error {
 	defer c.Close()
+	if n := s.InitialReceiveWindow; n < 0 || int64(n) >= 1<<31 {
+		return fmt.Errorf("spdy: InitialReceiveWindow %d out of range", n)
+	}
+	s.setKeepAlive(c)
+	var (
+		mu     sync.Mutex
+		active int
+		closed = make(chan struct{}) // closed when sess stops
+	)
 	fr := framing.NewFramer(c, c)
-	sess := framing.Start(fr, true, func(st *framing.Stream) {
-		s.serveStream(st, c)
+	if p := s.HeaderCompressionLevel; p != nil {
+		if err := fr.SetCompressionLevel(*p); err != nil {
+			return fmt.Errorf("spdy: HeaderCompressionLevel %d: %v", *p, err)
+		}
+	}
+	sess := framing.NewSession(fr, true, func(st *framing.Stream) {
+		mu.Lock()
+		if active++; active == 1 {
+			s.setState(c, http.StateActive)
+		}
+		mu.Unlock()
+		s.serveStream(st, c, closed)
+		mu.Lock()
+		if active--; active == 0 {
+			s.setState(c, http.StateIdle)
+		}
+		mu.Unlock()
 	})
-	return sess.Wait()
+	sess.WriteBufferSize = s.WriteBufferSize
+	sess.WriteFlushInterval = s.WriteFlushInterval
+	sess.MaxHandlers = s.MaxConcurrentStreams
+	sess.WindowTimeout = s.WindowTimeout
+	sess.ReceiveWindow = s.InitialReceiveWindow
+	sess.StrictHeaders = s.StrictHeaders
+	sess.RawHeaders = s.RawHeaders
+	sess.Logf = s.logf
+	if s.LogFrames {
+		sess.LogFrame = frameLogger(s.logf, c.RemoteAddr())
+	}
+	err := sess.Run()
+	close(closed)
+	return err
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// frameLogger returns a func for Session.LogFrame
+// that logs each frame with logf, noting the peer.
+func frameLogger(logf func(string, ...interface{}), peer net.Addr) func(framing.Frame, bool) {
+	return func(f framing.Frame, sent bool) {
+		dir := "from"
+		if sent {
+			dir = "to"
+		}
+		logf("spdy: %s %v: %s", dir, peer, framing.DumpFrame(f))
+	}
 }
 
-func (s *Server) serveStream(st *framing.Stream, c net.Conn) {
+// setKeepAlive turns on TCP keep-alives for c, or for the
+// connection underneath it if c is a *tls.Conn.
+func (s *Server) setKeepAlive(c net.Conn) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	kc, ok := c.(interface {
+		SetKeepAlive(bool) error
+		SetKeepAlivePeriod(time.Duration) error
+	})
+	if !ok || s.TCPKeepAlive < 0 {
+		return
+	}
+	d := s.TCPKeepAlive
+	if d == 0 {
+		d = defaultTCPKeepAlive
+	}
+	kc.SetKeepAlive(true)
+	kc.SetKeepAlivePeriod(d)
+}
+
+func (s *Server) setState(c net.Conn, state http.ConnState) {
+	if hook := s.ConnState; hook != nil {
+		hook(c, state)
+	}
+}
+
+func (s *Server) setStreamState(st *framing.Stream, state StreamState) {
+	if hook := s.StreamState; hook != nil {
+		hook(st, state)
+	}
+}
+
+func (s *Server) serveStream(st *framing.Stream, c net.Conn, closed <-chan struct{}) {
+	s.setStreamState(st, StreamNew)
+	defer s.setStreamState(st, StreamClosed)
 	// TODO(kr): recover
 	// TODO(kr): buffered reader and writer
 	w, err := readRequest(st)
-	if err != nil {
-		log.Println("spdy: read request failed:", err)
+	if _, ok := err.(headerError); ok {
+		// A malformed header block is a protocol error,
+		// not a bad HTTP request, so there's no reply.
+		s.logf("spdy: bad request header: %v", err)
+		st.Reset(framing.ProtocolError)
+		return
+	} else if err != nil {
+		s.logf("spdy: read request failed: %v", err)
 		st.Reply(http.Header{":status": {"400"}}, framing.ControlFlagFin)
 		st.Reset(framing.RefusedStream)
 		return
 	}
+	w.srv = s
+	// Cancel the request context if the stream is reset or the
+	// connection dies while the handler runs. The stream is also
+	// done once both sides have sent FLAG_FIN, which can happen
+	// on the handler's last Write; the handler isn't finished
+	// then, so that's no reason to cancel.
+	ctx, cancel := context.WithCancel(w.req.Context())
+	defer cancel()
+	go func() {
+		done := st.Done()
+		for {
+			select {
+			case <-done:
+				if st.Err() == io.EOF {
+					done = nil
+					continue
+				}
+			case <-closed:
+			case <-ctx.Done():
+			}
+			cancel()
+			return
+		}
+	}()
+	w.req = w.req.WithContext(ctx)
 	w.req.RemoteAddr = c.RemoteAddr().String()
-	handler := s.Handler
-	if handler == nil {
-		handler = http.DefaultServeMux
+	if s.KeepPseudoHeaders {
+		keepPseudoHeaders(w.req.Header, st.Header())
+	}
+	if s.ModifyRequest != nil {
+		s.ModifyRequest(w.req)
+	}
+	if !s.methodAllowed(w.req.Method) {
+		w.Header().Set("Allow", strings.Join(s.AllowedMethods, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.finishRequest()
+		return
 	}
-	handler.ServeHTTP(w, w.req)
+	s.setStreamState(st, StreamActive)
+	s.handler(w.req).ServeHTTP(w, w.req)
 	w.finishRequest()
 }
 
+// handler returns the handler for r, from Handlers
+// if r.Host is there, or else Handler.
+func (s *Server) handler(r *http.Request) http.Handler {
+	if s.Handlers != nil {
+		host := strings.ToLower(r.Host)
+		if h, ok := s.Handlers[host]; ok {
+			return h
+		}
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			if h, ok := s.Handlers[name]; ok {
+				return h
+			}
+		}
+	}
+	if s.Handler != nil {
+		return s.Handler
+	}
+	return http.DefaultServeMux
+}
+
+func (s *Server) methodAllowed(method string) bool {
+	if s.AllowedMethods == nil {
+		return true
+	}
+	for _, m := range s.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
 // This is our http.ResponseWriter.
 type response struct {
+	srv         *Server
 	stream      *framing.Stream
 	req         *http.Request
 	header      http.Header
+	trailers    []string // announced in the Trailer header field
 	wroteHeader bool
-	finished    bool
+	status      int    // as passed to writeHeader
+	fin         bool   // FLAG_FIN sent with the body
+	clen        int64  // declared Content-Length, or -1
+	written     int64  // body bytes written
+	buf         []byte // body not yet sent; see Server.ResponseBufferSize
+
+	// end is set atomically, once, by Abort or by finishRequest,
+	// whichever comes first. Abort doesn't take mu, so that it
+	// can interrupt a Write blocked on flow control.
+	end int32
+
+	// mu serializes writes, which can come from goroutines
+	// the handler started, with finishRequest. Once
+	// handlerDone is set, writes fail.
+	mu          sync.Mutex
+	handlerDone bool
+	loggedLate  bool
 }
 
+var errHandlerDone = errors.New("spdy: write after the handler returned")
+
 func readRequest(st *framing.Stream) (w *response, err error) {
 	req, err := ReadRequest(
 		st.Header(),
@@ -107,19 +593,116 @@ func readRequest(st *framing.Stream) (w *response, err error) {
 	w = new(response)
 	w.header = make(http.Header)
 	w.stream = st
-	w.req = req
+	w.req = req.WithContext(context.WithValue(req.Context(), StreamContextKey, st))
+	req.Body.(*body).res = w
 	return w, nil
 }
 
 func (w *response) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.handlerDone {
+		return 0, w.lateWrite()
+	}
 	if !w.wroteHeader {
-		w.WriteHeader(http.StatusOK)
+		w.writeHeader(http.StatusOK, false)
+	}
+	if w.aborted() {
+		return w.stream.Write(p) // fails; the stream was reset
 	}
 	// TODO(kr): sniff
-	return w.stream.Write(p)
+	if w.clen >= 0 && w.written+int64(len(p)) > w.clen {
+		return 0, http.ErrContentLength
+	}
+	if w.fin || len(p) == 0 {
+		return w.stream.Write(p)
+	}
+	w.written += int64(len(p))
+	if w.written == w.clen && !w.hasTrailer() {
+		// The body is complete. Save a frame by
+		// setting FLAG_FIN on the last of it.
+		w.fin = true
+		return w.writeTail(p)
+	}
+	size := 0
+	if w.srv != nil {
+		size = w.srv.ResponseBufferSize
+	}
+	if len(w.buf)+len(p) > size {
+		if err := w.flushBuf(); err != nil {
+			return 0, err
+		}
+		if len(p) >= size {
+			return w.stream.Write(p)
+		}
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// writeTail sends the buffered body followed by p,
+// with FLAG_FIN, and returns how much of p was sent.
+func (w *response) writeTail(p []byte) (int, error) {
+	b := append(w.buf, p...)
+	w.buf = nil
+	n, err := w.stream.WriteClose(b)
+	n -= len(b) - len(p)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// flushBuf sends the buffered body, if any.
+func (w *response) flushBuf() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.stream.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Flush sends any buffered response body to the client,
+// for handlers that stream, such as for server-sent events.
+// It implements http.Flusher.
+func (w *response) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.handlerDone {
+		w.lateWrite()
+		return
+	}
+	if !w.wroteHeader {
+		w.writeHeader(http.StatusOK, false)
+	}
+	if w.aborted() || w.fin {
+		return
+	}
+	err := w.flushBuf()
+	if err == nil {
+		err = w.stream.Flush()
+	}
+	if err != nil {
+		w.srv.logf("spdy: flush: %v", err)
+	}
 }
 
 func (w *response) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.handlerDone {
+		w.lateWrite()
+		return
+	}
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		// An interim response, such as 100 Continue or
+		// 103 Early Hints. SPDY/3 has no way to send one:
+		// a stream gets exactly one SYN_REPLY, and HEADERS
+		// frames only add to it. So we drop it and leave
+		// the header unwritten for the final status code.
+		return
+	}
 	// There can be body bytes after the header, so don't set
 	// FLAG_FIN. Worst case, we'll send an empty-payload data
 	// frame later.
@@ -127,18 +710,42 @@ func (w *response) WriteHeader(code int) {
 }
 
 func (w *response) writeHeader(code int, fin bool) {
+	if w.aborted() {
+		return
+	}
 	if w.wroteHeader {
 		log.Print("spdy: multiple response.WriteHeader calls")
 		return
 	}
 	w.wroteHeader = true
+	w.status = code
+	w.clen = -1
+	if cl := strings.TrimSpace(w.header.Get("Content-Length")); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			w.clen = n
+		}
+	}
+	for _, v := range w.header["Trailer"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				w.trailers = append(w.trailers, http.CanonicalHeaderKey(k))
+			}
+		}
+	}
 	h := w.framingHeader(code)
+	if w.srv != nil && w.srv.ModifyResponseHeader != nil {
+		w.srv.ModifyResponseHeader(h)
+	}
+	if w.clen == 0 && !w.hasTrailer() {
+		fin = true // no body to wait for
+	}
 	var flag framing.ControlFlags
 	if fin {
 		flag |= framing.ControlFlagFin
+		w.fin = true
 	}
 	err := w.stream.Reply(h, flag)
-	if err != nil {
+	if err != nil && !w.streamDone() {
 		log.Println("spdy:", err)
 		w.stream.Reset(framing.InternalError)
 	}
@@ -148,7 +755,6 @@ func (w *response) framingHeader(code int) http.Header {
 	h := make(http.Header)
 	copyHeader(h, w.header)
 	// TODO(kr): enforce correct Content-Length
-	// TODO(kr): set FLAG_FIN if Content-Length is 0
 	if conn := h.Get("Connection"); conn != "" && conn != "close" {
 		log.Printf("spdy: invalid Connection set")
 	}
@@ -173,31 +779,202 @@ func (w *response) framingHeader(code int) http.Header {
 	h.Set(":status", codestring+" "+statusText)
 	h.Set(":version", "HTTP/1.1")
 	h.Del("Connection")
+	for k := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			delete(h, k)
+		}
+	}
 	// TODO(kr): delete other spdy-prohibited header fields
 	return h
 }
 
+func (w *response) hasTrailer() bool {
+	for k := range w.header {
+		if k == "Trailer" || strings.HasPrefix(k, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// trailer returns the trailer fields set by the handler, either
+// announced in the Trailer header field or named with
+// http.TrailerPrefix. It returns nil if there are none.
+func (w *response) trailer() http.Header {
+	var t http.Header
+	add := func(k string, vv []string) {
+		if len(vv) == 0 {
+			return
+		}
+		if t == nil {
+			t = make(http.Header)
+		}
+		t[k] = append(t[k], vv...)
+	}
+	for _, k := range w.trailers {
+		add(k, w.header[k])
+	}
+	for k, vv := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			add(http.CanonicalHeaderKey(k[len(http.TrailerPrefix):]), vv)
+		}
+	}
+	return t
+}
+
 func (w *response) Header() http.Header {
 	return w.header
 }
 
+// CloseRead stops reading the request body, for handlers
+// that only send, such as for server-sent events. It frees
+// the stream's receive buffer. See framing.Stream.CloseRead.
+// Handlers can reach it with a type assertion:
+//
+//	w.(interface{ CloseRead() error }).CloseRead()
+func (w *response) CloseRead() error {
+	return w.stream.CloseRead()
+}
+
+// Abort resets the stream with RST_STREAM and the given
+// status, such as framing.Cancel or framing.InternalError,
+// for a handler that can't finish its response. Anything
+// the handler writes afterward is dropped, and the server
+// sends nothing more when the handler returns. The client
+// sees an error reading the body, rather than a clean EOF
+// after a truncated one. Handlers reach it through Aborter.
+func (w *response) Abort(status framing.RstStreamStatus) {
+	// A Write blocked on flow control holds w.mu,
+	// and only the reset can unblock it.
+	if atomic.CompareAndSwapInt32(&w.end, 0, endAborted) {
+		w.stream.Reset(status)
+	}
+}
+
+const (
+	endAborted = 1 + iota
+	endHandler
+)
+
+func (w *response) aborted() bool {
+	return atomic.LoadInt32(&w.end) == endAborted
+}
+
+// lateWrite logs, once per response, that something wrote
+// to w after the handler returned, such as a goroutine the
+// handler left behind, and returns the error for the write.
+// The stream may be gone by then, or even reused by the peer,
+// so the write must not reach it.
+func (w *response) lateWrite() error {
+	if !w.loggedLate {
+		w.loggedLate = true
+		w.srv.logf("spdy: response written after its handler returned")
+	}
+	return errHandlerDone
+}
+
 func (w *response) finishRequest() {
-	if !w.wroteHeader {
-		// If the user never wrote the header, they also wrote no
-		// body bytes, so we can set FLAG_FIN immediately and
-		// we're done.
-		w.writeHeader(http.StatusOK, true)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.handlerDone = true
+	if !atomic.CompareAndSwapInt32(&w.end, 0, endHandler) {
+		return // aborted
+	}
+	if w.streamDone() {
+		return // reset by the client or the handler
+	}
+	defer w.cancelRequestBody()
+	if w.fin {
+		return // the body carried FLAG_FIN
+	}
+	if w.wroteHeader && w.written < w.clen && w.bodyAllowed() {
+		// Ending the stream would leave the client with
+		// a short body. Fail the response instead.
+		w.srv.logf("spdy: handler wrote %d of %d bytes declared in Content-Length", w.written, w.clen)
+		w.stream.Reset(framing.InternalError)
 		return
 	}
+	if !w.wroteHeader {
+		if !w.hasTrailer() {
+			// If the user never wrote the header, they also wrote no
+			// body bytes, so we can set FLAG_FIN immediately and
+			// we're done.
+			w.writeHeader(http.StatusOK, true)
+			return
+		}
+		// The trailer needs a frame of its own.
+		w.writeHeader(http.StatusOK, false)
+	}
 	// TODO(kr): sniff
-	err := w.stream.Close()
+	var err error
+	if t := w.trailer(); t != nil {
+		if err = w.flushBuf(); err == nil {
+			err = w.stream.SendHeaders(t, framing.ControlFlagFin)
+		}
+	} else if len(w.buf) > 0 {
+		// Save a frame by setting FLAG_FIN
+		// on the last of the body.
+		_, err = w.writeTail(nil)
+	} else {
+		err = w.stream.Close()
+	}
 	if err != nil {
 		log.Println("spdy:", err)
 	}
 }
 
+// bodyAllowed reports whether the response may have a body,
+// so that its Content-Length is the length of the body.
+func (w *response) bodyAllowed() bool {
+	switch {
+	case w.req != nil && w.req.Method == "HEAD":
+		return false
+	case w.status == http.StatusNoContent, w.status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// cancelRequestBody resets the stream with CANCEL if, with
+// the response done, the client is still sending the request
+// body. Nobody will read the rest, so without the reset the
+// client would wait forever for window to send it.
+func (w *response) cancelRequestBody() {
+	if !w.streamDone() {
+		w.stream.Reset(framing.Cancel)
+	}
+}
+
+// streamDone reports whether the stream is closed in both
+// directions. Before the response is complete, that means
+// it was reset, and there is nothing more to send on it.
+func (w *response) streamDone() bool {
+	select {
+	case <-w.stream.Done():
+		return true
+	default:
+		return false
+	}
+}
+
 // TODO(kr): func (w *response) Push() http.ResponseWriter
 
+// keepPseudoHeaders copies the ':' fields of src into dst,
+// renaming :name to X-Spdy-Name, after removing any fields
+// from dst that already have that prefix.
+func keepPseudoHeaders(dst, src http.Header) {
+	for k := range dst {
+		if strings.HasPrefix(k, "X-Spdy-") {
+			delete(dst, k)
+		}
+	}
+	for k, vv := range src {
+		if len(k) > 1 && k[0] == ':' {
+			dst[http.CanonicalHeaderKey("X-Spdy-"+k[1:])] = vv
+		}
+	}
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		if len(k) > 0 && k[0] != ':' {
@@ -59,6 +59,18 @@ func (b *buffer) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
+// Grow makes the buffer hold at least n bytes.
+// Unlike the other methods, it may allocate.
+func (b *buffer) Grow(n int) {
+	if n <= len(b.buf) {
+		return
+	}
+	buf := make([]byte, n)
+	b.w = copy(buf, b.buf[b.r:b.w])
+	b.r = 0
+	b.buf = buf
+}
+
 // Close marks the buffer as closed. Future calls to Write will
 // return an error. Future calls to Read, once the buffer is
 // empty, will return err.
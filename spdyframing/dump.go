@@ -0,0 +1,54 @@
+package spdyframing
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// DumpFrame returns a human-readable representation of f,
+// for debugging. The first line gives the frame type, stream
+// id, flags, and other fixed fields. For frames with a header
+// block, each header field follows on a line of its own,
+// indented, in the order they would be written.
+func DumpFrame(f Frame) string {
+	var b bytes.Buffer
+	switch f := f.(type) {
+	case *SynStreamFrame:
+		fmt.Fprintf(&b, "SYN_STREAM stream=%d flags=%#02x assoc=%d priority=%d slot=%d",
+			f.StreamId, f.CFHeader.Flags, f.AssociatedToStreamId, f.Priority, f.Slot)
+		dumpHeader(&b, f.Headers)
+	case *SynReplyFrame:
+		fmt.Fprintf(&b, "SYN_REPLY stream=%d flags=%#02x", f.StreamId, f.CFHeader.Flags)
+		dumpHeader(&b, f.Headers)
+	case *RstStreamFrame:
+		fmt.Fprintf(&b, "RST_STREAM stream=%d status=%d", f.StreamId, f.Status)
+	case *SettingsFrame:
+		fmt.Fprintf(&b, "SETTINGS flags=%#02x", f.CFHeader.Flags)
+		for _, v := range f.FlagIdValues {
+			fmt.Fprintf(&b, "\n\tid=%d flags=%#02x value=%d", v.Id, v.Flag, v.Value)
+		}
+	case *PingFrame:
+		fmt.Fprintf(&b, "PING id=%d", f.Id)
+	case *GoAwayFrame:
+		fmt.Fprintf(&b, "GOAWAY last-good-stream=%d status=%d", f.LastGoodStreamId, f.Status)
+	case *HeadersFrame:
+		fmt.Fprintf(&b, "HEADERS stream=%d flags=%#02x", f.StreamId, f.CFHeader.Flags)
+		dumpHeader(&b, f.Headers)
+	case *WindowUpdateFrame:
+		fmt.Fprintf(&b, "WINDOW_UPDATE stream=%d delta=%d", f.StreamId, f.DeltaWindowSize)
+	case *DataFrame:
+		fmt.Fprintf(&b, "DATA stream=%d flags=%#02x length=%d", f.StreamId, f.Flags, len(f.Data))
+	default:
+		fmt.Fprintf(&b, "%T %+v", f, f)
+	}
+	return b.String()
+}
+
+func dumpHeader(b *bytes.Buffer, h http.Header) {
+	for _, k := range headerOrder(h) {
+		for _, v := range h[k] {
+			fmt.Fprintf(b, "\n\t%s: %s", k, v)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package spdyframing
+
+import (
+	"net/http"
+	"testing"
+)
+
+var dumpTests = []struct {
+	f    Frame
+	want string
+}{
+	{
+		&SynStreamFrame{
+			CFHeader: ControlFrameHeader{Flags: ControlFlagFin},
+			StreamId: 1,
+			Priority: 3,
+			Headers:  http.Header{"X": {"a", "b"}, ":method": {"GET"}},
+		},
+		"SYN_STREAM stream=1 flags=0x01 assoc=0 priority=3 slot=0\n\t:method: GET\n\tX: a\n\tX: b",
+	},
+	{
+		&SynReplyFrame{StreamId: 1, Headers: http.Header{":status": {"200 OK"}}},
+		"SYN_REPLY stream=1 flags=0x00\n\t:status: 200 OK",
+	},
+	{
+		&RstStreamFrame{StreamId: 3, Status: Cancel},
+		"RST_STREAM stream=3 status=5",
+	},
+	{
+		&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+			{Id: SettingsMaxConcurrentStreams, Value: 100},
+			{Id: SettingsInitialWindowSize, Flag: FlagSettingsPersistValue, Value: 1000},
+		}},
+		"SETTINGS flags=0x00\n\tid=4 flags=0x00 value=100\n\tid=7 flags=0x01 value=1000",
+	},
+	{
+		&PingFrame{Id: 2},
+		"PING id=2",
+	},
+	{
+		&GoAwayFrame{LastGoodStreamId: 7, Status: GoAwayInternalError},
+		"GOAWAY last-good-stream=7 status=2",
+	},
+	{
+		&HeadersFrame{StreamId: 5, Headers: http.Header{"X-Sum": {"42"}}},
+		"HEADERS stream=5 flags=0x00\n\tX-Sum: 42",
+	},
+	{
+		&WindowUpdateFrame{StreamId: 5, DeltaWindowSize: 1024},
+		"WINDOW_UPDATE stream=5 delta=1024",
+	},
+	{
+		&DataFrame{StreamId: 5, Flags: DataFlagFin, Data: []byte("hello")},
+		"DATA stream=5 flags=0x01 length=5",
+	},
+}
+
+func TestDumpFrame(t *testing.T) {
+	for i, tt := range dumpTests {
+		if g := DumpFrame(tt.f); g != tt.want {
+			t.Errorf("#%d: DumpFrame =\n%s\nwant\n%s", i, g, tt.want)
+		}
+	}
+}
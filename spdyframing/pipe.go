@@ -1,13 +1,16 @@
 package spdyframing
 
 import (
+	"io"
 	"sync"
 )
 
 type pipe struct {
-	b buffer
-	c sync.Cond
-	m sync.Mutex
+	b      buffer
+	size   int   // max capacity of b; Write grows b up to this
+	chunks []int // lengths of unread data from each Write
+	c      sync.Cond
+	m      sync.Mutex
 }
 
 // Read waits until data is available and copies bytes
@@ -18,7 +21,61 @@ func (r *pipe) Read(p []byte) (n int, err error) {
 	for r.b.Len() == 0 && !r.b.closed {
 		r.c.Wait()
 	}
-	return r.b.Read(p)
+	n, err = r.b.Read(p)
+	r.consume(n)
+	return n, err
+}
+
+// ReadChunk waits until data is available and returns
+// the unread bytes from a single call to Write.
+// Eof reports whether the buffer was closed with io.EOF
+// and no data remains after p.
+func (r *pipe) ReadChunk() (p []byte, eof bool, err error) {
+	r.c.L.Lock()
+	defer r.c.L.Unlock()
+	for r.b.Len() == 0 && !r.b.closed {
+		r.c.Wait()
+	}
+	if len(r.chunks) > 0 {
+		p = make([]byte, r.chunks[0])
+		r.b.Read(p)
+		r.chunks = r.chunks[1:]
+	} else {
+		err = r.b.err
+	}
+	eof = r.b.closed && r.b.Len() == 0 && r.b.err == io.EOF
+	return p, eof, err
+}
+
+// Skip waits until data is available and drops all
+// of it from the buffer, returning the number of bytes
+// dropped. Err is the error given to Close once no data
+// remains.
+func (r *pipe) Skip() (n int, err error) {
+	r.c.L.Lock()
+	defer r.c.L.Unlock()
+	for r.b.Len() == 0 && !r.b.closed {
+		r.c.Wait()
+	}
+	n = r.b.Len()
+	r.b.r, r.b.w = 0, 0
+	r.chunks = r.chunks[:0]
+	if r.b.closed {
+		err = r.b.err
+	}
+	return n, err
+}
+
+// consume removes n bytes from the front of r.chunks.
+func (r *pipe) consume(n int) {
+	for n > 0 {
+		if r.chunks[0] > n {
+			r.chunks[0] -= n
+			return
+		}
+		n -= r.chunks[0]
+		r.chunks = r.chunks[1:]
+	}
 }
 
 // Write copies bytes from p into the buffer and wakes a reader.
@@ -27,7 +84,31 @@ func (w *pipe) Write(p []byte) (n int, err error) {
 	w.c.L.Lock()
 	defer w.c.L.Unlock()
 	defer w.c.Signal()
-	return w.b.Write(p)
+	if need := w.b.Len() + len(p); need > len(w.b.buf) && len(w.b.buf) < w.size && !w.b.closed {
+		w.b.Grow(growSize(len(w.b.buf), need, w.size))
+	}
+	n, err = w.b.Write(p)
+	if n > 0 {
+		w.chunks = append(w.chunks, n)
+	}
+	return n, err
+}
+
+// Grow lets the buffer hold at least n bytes.
+// It doesn't allocate; Write grows the buffer as needed.
+func (c *pipe) Grow(n int) {
+	c.c.L.Lock()
+	defer c.c.L.Unlock()
+	if n > c.size {
+		c.size = n
+	}
+}
+
+// Size returns the most the buffer can hold.
+func (c *pipe) Size() int {
+	c.c.L.Lock()
+	defer c.c.L.Unlock()
+	return c.size
 }
 
 func (c *pipe) Close(err error) {
@@ -36,3 +117,36 @@ func (c *pipe) Close(err error) {
 	defer c.c.Signal()
 	c.b.Close(err)
 }
+
+// Discard closes the pipe like Close, but also drops any
+// unread data and frees the buffer. It returns the number
+// of bytes dropped.
+func (c *pipe) Discard(err error) (n int) {
+	c.c.L.Lock()
+	defer c.c.L.Unlock()
+	defer c.c.Signal()
+	n = c.b.Len()
+	c.b.Close(err)
+	c.b.buf = nil
+	c.b.r, c.b.w = 0, 0
+	c.chunks = nil
+	return n
+}
+
+// minPipeBuf is the smallest buffer a pipe allocates.
+const minPipeBuf = 512
+
+// growSize returns a new buffer size for a buffer of size n
+// to hold need bytes, doubling n, but no more than max.
+func growSize(n, need, max int) int {
+	if n < minPipeBuf {
+		n = minPipeBuf
+	}
+	for n < need {
+		n *= 2
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
@@ -2,6 +2,7 @@ package spdyframing
 
 import (
 	"errors"
+	"io"
 	"testing"
 )
 
@@ -17,3 +18,100 @@ func TestPipeClose(t *testing.T) {
 		t.Errorf("err = %v want %v", err, a)
 	}
 }
+
+func TestPipeMixedReads(t *testing.T) {
+	var p pipe
+	p.b.buf = make([]byte, 16)
+	p.c.L = &p.m
+	read := func(n int) string {
+		b := make([]byte, n)
+		n, err := p.Read(b)
+		if err != nil {
+			t.Fatalf("Read err = %v", err)
+		}
+		return string(b[:n])
+	}
+	type chunk struct {
+		p   string
+		eof bool
+		err error
+	}
+	readChunk := func() chunk {
+		b, eof, err := p.ReadChunk()
+		return chunk{string(b), eof, err}
+	}
+
+	for _, s := range []string{"abc", "de", "f"} {
+		p.Write([]byte(s))
+	}
+	if g := read(2); g != "ab" {
+		t.Errorf("Read = %q want %q", g, "ab")
+	}
+	if g, w := readChunk(), (chunk{"c", false, nil}); g != w {
+		t.Errorf("ReadChunk = %+v want %+v", g, w)
+	}
+	if g := read(10); g != "def" {
+		t.Errorf("Read = %q want %q", g, "def")
+	}
+
+	// Sliding data to the front of the buffer
+	// doesn't disturb the chunk boundaries.
+	for _, s := range []string{"ghijklmnop", "qrst", "vw"} {
+		p.Write([]byte(s))
+	}
+	p.Close(io.EOF)
+	want := []chunk{
+		{"ghijklmnop", false, nil},
+		{"qrst", false, nil},
+		{"vw", true, nil},
+		{"", true, io.EOF},
+	}
+	for i, w := range want {
+		if g := readChunk(); g != w {
+			t.Errorf("#%d: ReadChunk = %+v want %+v", i, g, w)
+		}
+	}
+}
+
+func TestPipeDiscard(t *testing.T) {
+	var p pipe
+	p.b.buf = make([]byte, 16)
+	p.c.L = &p.m
+	p.Write([]byte("abc"))
+	if n := p.Discard(errReadClosed); n != 3 {
+		t.Errorf("Discard = %d want 3", n)
+	}
+	if n, err := p.Read(make([]byte, 10)); n != 0 || err != errReadClosed {
+		t.Errorf("Read = %d, %v want 0, %v", n, err, errReadClosed)
+	}
+	if p.b.buf != nil {
+		t.Errorf("buffer not freed")
+	}
+	if _, err := p.Write([]byte("d")); err == nil {
+		t.Errorf("Write succeeded after Discard")
+	}
+}
+
+func TestPipeGrow(t *testing.T) {
+	var p pipe
+	p.size = 2048
+	p.c.L = &p.m
+	if p.b.buf != nil {
+		t.Fatal("buffer allocated before Write")
+	}
+	p.Write(make([]byte, 10))
+	if g := len(p.b.buf); g != minPipeBuf {
+		t.Errorf("len(buf) = %d want %d", g, minPipeBuf)
+	}
+	p.Write(make([]byte, 1000))
+	if g := len(p.b.buf); g != 1024 {
+		t.Errorf("len(buf) = %d want %d", g, 1024)
+	}
+	n, err := p.Write(make([]byte, 2000))
+	if n != 1038 || err != errWriteFull {
+		t.Errorf("Write = %d, %v want %d, %v", n, err, 1038, errWriteFull)
+	}
+	if g := len(p.b.buf); g != 2048 {
+		t.Errorf("len(buf) = %d want %d (size)", g, 2048)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"io"
 	"net/http"
+	"net/textproto"
 	"strings"
 )
 
@@ -143,6 +144,11 @@ func (f *Framer) uncorkHeaderDecompressor(payloadSize int64) error {
 }
 
 // ReadFrame reads SPDY encoded data and returns a decompressed Frame.
+//
+// If a header block has a field name that isn't lowercase,
+// ReadFrame returns the frame, with its names lowercased,
+// along with an *Error with code UnlowercasedHeaderName.
+// The caller may reject the frame or use it anyway.
 func (f *Framer) ReadFrame() (Frame, error) {
 	var firstWord uint32
 	if err := binary.Read(f.r, binary.BigEndian, &firstWord); err != nil {
@@ -168,29 +174,110 @@ func (f *Framer) parseControlFrame(version uint16, frameType ControlFrameType) (
 	if err != nil {
 		return nil, err
 	}
-	if err = cframe.read(header, f); err != nil {
+	if err = cframe.read(header, f); isUnlowercased(err) {
+		return cframe, err
+	} else if err != nil {
 		return nil, err
 	}
 	return cframe, nil
 }
 
-func parseHeaderValueBlock(r io.Reader, streamId StreamId) (http.Header, error) {
-	var numHeaders uint32
-	if err := binary.Read(r, binary.BigEndian, &numHeaders); err != nil {
+func isUnlowercased(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Err == UnlowercasedHeaderName
+}
+
+// readHeaderBlock reads and parses a header block
+// that occupies size bytes on the wire.
+func (f *Framer) readHeaderBlock(size int64, streamId StreamId) (http.Header, error) {
+	reader := f.r
+	if !f.headerCompressionDisabled {
+		err := f.uncorkHeaderDecompressor(size)
+		if err != nil {
+			return nil, err
+		}
+		reader = f.headerDecompressor
+	}
+	cr := &countReader{r: reader}
+	var raw *[]HeaderField
+	f.rawHeader = nil
+	if f.keepRaw {
+		raw = &f.rawHeader
+	}
+	h, err := parseHeaderValueBlock(cr, streamId, raw)
+	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
+		err = &Error{WrongCompressedPayloadSize, 0}
+	}
+	f.headerSize = HeaderSize{Wire: size, Decoded: cr.n}
+	return h, err
+}
+
+// HeaderSize returns the size of the header block
+// in the last frame read by ReadFrame.
+// It is valid only if that frame was SYN_STREAM,
+// SYN_REPLY, or HEADERS.
+func (f *Framer) HeaderSize() HeaderSize {
+	return f.headerSize
+}
+
+// RawHeader returns the fields of the header block in the
+// last frame read by ReadFrame, in the order they were sent,
+// or nil if KeepRawHeader is off. Like HeaderSize, it is
+// valid only if that frame was SYN_STREAM, SYN_REPLY, or
+// HEADERS.
+func (f *Framer) RawHeader() []HeaderField {
+	return f.rawHeader
+}
+
+// HeaderSize holds the size in bytes of a header block.
+type HeaderSize struct {
+	Wire    int64 // as sent, possibly compressed
+	Decoded int64 // after decompression
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// parseHeaderValueBlock parses a header block from r.
+// If raw is non-nil, it also appends each field to *raw
+// as it was sent.
+func parseHeaderValueBlock(r io.Reader, streamId StreamId, raw *[]HeaderField) (http.Header, error) {
+	// One scratch buffer serves for every length, name, and value,
+	// to keep allocations down on small requests.
+	buf := make([]byte, 64)
+	readLen := func() (int, error) {
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint32(buf)), nil
+	}
+	numHeaders, err := readLen()
+	if err != nil {
 		return nil, err
 	}
 	var e error
-	h := make(http.Header, int(numHeaders))
-	for i := 0; i < int(numHeaders); i++ {
-		var length uint32
-		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+	h := make(http.Header, numHeaders)
+	for i := 0; i < numHeaders; i++ {
+		length, err := readLen()
+		if err != nil {
 			return nil, err
 		}
-		nameBytes := make([]byte, length)
-		if _, err := io.ReadFull(r, nameBytes); err != nil {
+		if length > len(buf) {
+			buf = make([]byte, length)
+		}
+		if _, err := io.ReadFull(r, buf[:length]); err != nil {
 			return nil, err
 		}
-		name := string(nameBytes)
+		name := string(buf[:length])
+		sentName := name
 		if name != strings.ToLower(name) {
 			e = &Error{UnlowercasedHeaderName, streamId}
 			name = strings.ToLower(name)
@@ -198,17 +285,22 @@ func parseHeaderValueBlock(r io.Reader, streamId StreamId) (http.Header, error)
 		if h[name] != nil {
 			e = &Error{DuplicateHeaders, streamId}
 		}
-		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		if length, err = readLen(); err != nil {
 			return nil, err
 		}
-		value := make([]byte, length)
-		if _, err := io.ReadFull(r, value); err != nil {
+		if length > len(buf) {
+			buf = make([]byte, length)
+		}
+		if _, err := io.ReadFull(r, buf[:length]); err != nil {
 			return nil, err
 		}
-		valueList := strings.Split(string(value), headerValueSeparator)
-		for _, v := range valueList {
-			h.Add(name, v)
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		value := string(buf[:length])
+		if raw != nil {
+			*raw = append(*raw, HeaderField{sentName, value})
 		}
+		valueList := strings.Split(value, headerValueSeparator)
+		h[key] = append(h[key], valueList...)
 	}
 	if e != nil {
 		return h, e
@@ -232,19 +324,8 @@ func (f *Framer) readSynStreamFrame(h ControlFrameHeader, frame *SynStreamFrame)
 	if err = binary.Read(f.r, binary.BigEndian, &frame.Slot); err != nil {
 		return err
 	}
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 10))
-		if err != nil {
-			return err
-		}
-		reader = f.headerDecompressor
-	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
-	}
-	if err != nil {
+	frame.Headers, err = f.readHeaderBlock(int64(h.length-10), frame.StreamId)
+	if err != nil && !isUnlowercased(err) {
 		return err
 	}
 	for h := range frame.Headers {
@@ -255,7 +336,7 @@ func (f *Framer) readSynStreamFrame(h ControlFrameHeader, frame *SynStreamFrame)
 	if frame.StreamId == 0 {
 		return &Error{ZeroStreamId, 0}
 	}
-	return nil
+	return err // nil, or names weren't lowercase
 }
 
 func (f *Framer) readSynReplyFrame(h ControlFrameHeader, frame *SynReplyFrame) error {
@@ -264,19 +345,8 @@ func (f *Framer) readSynReplyFrame(h ControlFrameHeader, frame *SynReplyFrame) e
 	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
 		return err
 	}
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 4))
-		if err != nil {
-			return err
-		}
-		reader = f.headerDecompressor
-	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
-	}
-	if err != nil {
+	frame.Headers, err = f.readHeaderBlock(int64(h.length-4), frame.StreamId)
+	if err != nil && !isUnlowercased(err) {
 		return err
 	}
 	for h := range frame.Headers {
@@ -287,7 +357,7 @@ func (f *Framer) readSynReplyFrame(h ControlFrameHeader, frame *SynReplyFrame) e
 	if frame.StreamId == 0 {
 		return &Error{ZeroStreamId, 0}
 	}
-	return nil
+	return err // nil, or names weren't lowercase
 }
 
 func (f *Framer) readHeadersFrame(h ControlFrameHeader, frame *HeadersFrame) error {
@@ -296,19 +366,8 @@ func (f *Framer) readHeadersFrame(h ControlFrameHeader, frame *HeadersFrame) err
 	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
 		return err
 	}
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 4))
-		if err != nil {
-			return err
-		}
-		reader = f.headerDecompressor
-	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
-	}
-	if err != nil {
+	frame.Headers, err = f.readHeaderBlock(int64(h.length-4), frame.StreamId)
+	if err != nil && !isUnlowercased(err) {
 		return err
 	}
 	var invalidHeaders map[string]bool
@@ -325,7 +384,7 @@ func (f *Framer) readHeadersFrame(h ControlFrameHeader, frame *HeadersFrame) err
 	if frame.StreamId == 0 {
 		return &Error{ZeroStreamId, 0}
 	}
-	return nil
+	return err // nil, or names weren't lowercase
 }
 
 func (f *Framer) parseDataFrame(streamId StreamId) (*DataFrame, error) {
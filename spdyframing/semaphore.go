@@ -3,6 +3,7 @@ package spdyframing
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 type semaphore struct {
@@ -13,10 +14,28 @@ type semaphore struct {
 	err    error
 }
 
+var errSemaphoreTimeout = errors.New("timed out")
+
 func (s *semaphore) Dec(n int32) (int32, error) {
+	return s.DecTimeout(n, 0)
+}
+
+// DecTimeout is like Dec, but if d is positive, it gives up
+// after waiting for d for the count to rise above zero.
+func (s *semaphore) DecTimeout(n int32, d time.Duration) (int32, error) {
 	s.c.L.Lock()
 	defer s.c.L.Unlock()
+	var deadline time.Time
 	for s.n < 1 && !s.closed {
+		if d > 0 {
+			if deadline.IsZero() {
+				deadline = time.Now().Add(d)
+				t := time.AfterFunc(d, s.wake)
+				defer t.Stop()
+			} else if !time.Now().Before(deadline) {
+				return 0, errSemaphoreTimeout
+			}
+		}
 		s.c.Wait()
 	}
 	if s.closed {
@@ -29,6 +48,12 @@ func (s *semaphore) Dec(n int32) (int32, error) {
 	return n, nil
 }
 
+func (s *semaphore) wake() {
+	s.c.L.Lock()
+	defer s.c.L.Unlock()
+	s.c.Broadcast()
+}
+
 func (s *semaphore) Inc(n int32) error {
 	s.c.L.Lock()
 	defer s.c.L.Unlock()
@@ -43,10 +68,29 @@ func (s *semaphore) Inc(n int32) error {
 	return nil
 }
 
-func (s *semaphore) Close(err error) {
+// Adjust adds delta, which may be negative, to the count.
+// The count may go below zero, in which case Dec blocks
+// until it is raised above zero again. It is an error for
+// the count to leave the range of an int32.
+func (s *semaphore) Adjust(delta int32) error {
 	s.c.L.Lock()
 	defer s.c.L.Unlock()
 	defer s.c.Signal()
+
+	n := int64(s.n) + int64(delta)
+	if n > 1<<31-1 || n < -1<<31 {
+		return errors.New("bad adjustment")
+	}
+	s.n = int32(n)
+	return nil
+}
+
+// Close makes Dec fail with err from now on, waking
+// every goroutine waiting in Dec, not just one.
+func (s *semaphore) Close(err error) {
+	s.c.L.Lock()
+	defer s.c.L.Unlock()
+	defer s.c.Broadcast()
 	if !s.closed {
 		s.closed = true
 		s.err = err
@@ -3,6 +3,7 @@ package spdyframing
 import (
 	"errors"
 	"testing"
+	"time"
 )
 
 func TestSemaphoreClose(t *testing.T) {
@@ -18,3 +19,50 @@ func TestSemaphoreClose(t *testing.T) {
 		t.Errorf("err = %v want %v", err, a)
 	}
 }
+
+func TestSemaphoreCloseWaiters(t *testing.T) {
+	const n = 5
+	var s semaphore
+	s.c.L = &s.m
+	a := errors.New("a")
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := s.Dec(1)
+			errs <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond) // let them block in Dec
+	s.Close(a)
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errs:
+			if err != a {
+				t.Errorf("err = %v want %v", err, a)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d waiters still blocked after Close", n-i, n)
+		}
+	}
+}
+
+func TestSemaphoreAdjust(t *testing.T) {
+	var s semaphore
+	s.n = 10
+	s.c.L = &s.m
+	if err := s.Adjust(-15); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Adjust(20); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Dec(100); n != 15 || err != nil {
+		t.Errorf("Dec = %d, %v want 15, nil", n, err)
+	}
+	if err := s.Adjust(1<<31 - 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Adjust(1); err == nil {
+		t.Error("Adjust past 1<<31-1 err = nil")
+	}
+}
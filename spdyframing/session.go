@@ -1,83 +1,388 @@
 package spdyframing
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // See SPDY/3 section 2.6.8.
 const defaultInitWnd = 64 * 1024
 
+const defaultWriteBufferSize = 4096
+
 var (
-	errClosed      = errors.New("closed")
-	errNotReadable = errors.New("not readable")
-	errCannotReply = errors.New("cannot reply")
-	errNotWritable = errors.New("not writable; must reply first")
-	errFlowControl = errors.New("flow control")
+	errClosed        = errors.New("closed")
+	errNotReadable   = errors.New("not readable")
+	errReadClosed    = errors.New("closed for reading")
+	errCannotReply   = errors.New("cannot reply")
+	errNotWritable   = errors.New("not writable; must reply first")
+	errFlowControl   = errors.New("flow control")
+	errWindowTimeout = errors.New("timed out waiting for WINDOW_UPDATE")
 )
 
+// ErrSessionClosing is returned by Open once the session has
+// stopped, for example because the connection was closed.
+// The caller can open the stream on a new connection.
+var ErrSessionClosing = errors.New("spdy: session closing")
+
+// ErrGoingAway is returned by Open once either endpoint has
+// sent GOAWAY. It is also how a stream we opened fails if the
+// peer's GOAWAY says it won't process it, that is, if its id is
+// above LastGoodStreamId. Either way, the peer hasn't acted on
+// the stream, so the caller can retry it on a new connection.
+var ErrGoingAway = errors.New("spdy: going away")
+
+// ErrKeepAliveTimeout is returned by Wait and Run when the
+// session stopped because the peer didn't answer a keepalive
+// PING. See Session.KeepAlive.
+var ErrKeepAliveTimeout = errors.New("spdy: peer did not answer keepalive PING")
+
+// GoAwayError is the error returned by Wait and Run when
+// the peer sent GOAWAY with a status other than GoAwayOK
+// before closing the connection.
+type GoAwayError struct {
+	LastGoodStreamId StreamId
+	Status           GoAwayStatus
+}
+
+func (e *GoAwayError) Error() string {
+	return fmt.Sprintf("peer sent GOAWAY: status %d, last good stream %d", e.Status, e.LastGoodStreamId)
+}
+
 type resetError RstStreamStatus
 
 func (e resetError) Error() string {
 	return fmt.Sprintf("stream was reset: %d", e)
 }
 
+// ResetStatus reports whether err is the error a stream
+// fails with once RST_STREAM has closed it, such as from
+// Stream.Err or Read, and if so, with what status.
+func ResetStatus(err error) (status RstStreamStatus, ok bool) {
+	e, ok := err.(resetError)
+	return RstStreamStatus(e), ok
+}
+
 // Session represents a session in the low-level SPDY framing layer.
+//
+// A session reads frames on a single goroutine. All header
+// blocks on a connection share one compression context, so
+// they must be decompressed in order, and a large one holds up
+// every frame behind it. That is inherent in SPDY/3. Nothing
+// else is serialized behind it: each incoming stream gets its
+// own handler goroutine, or, if MaxHandlers is set, waits in
+// a queue of at most HandlerQueue streams for one from a fixed
+// pool and is refused when that queue is full; DATA goes
+// straight into the stream's buffer; and frames sent in
+// response, such as RST_STREAM and PING echoes, go through a
+// queue to a separate writer. So the read goroutine never
+// waits for a handler, or for the connection to accept
+// writes, unless the writer's queue fills up.
 type Session struct {
+	// WriteBufferSize is the size of the buffer for outgoing
+	// frames. If it and WriteFlushInterval are both zero,
+	// frames are written to the Framer's writer unbuffered.
+	WriteBufferSize int
+
+	// WriteFlushInterval is how long a frame may wait in the
+	// write buffer for others to join it before the buffer is
+	// flushed. If zero, the buffer is flushed after every frame.
+	// The buffer is always flushed when it fills up, and
+	// Stream.Flush flushes it at once.
+	WriteFlushInterval time.Duration
+
+	// MaxHandlers, if positive, is the size of a fixed pool
+	// of goroutines that call the handler, so that at most
+	// MaxHandlers incoming streams are handled at once.
+	// Streams wait in order for a free goroutine. If zero,
+	// each incoming stream gets a goroutine of its own.
+	MaxHandlers int
+
+	// HandlerQueue is how many incoming streams may wait
+	// for a handler when MaxHandlers are busy. Beyond that,
+	// new streams are refused with RST_STREAM.
+	HandlerQueue int
+
+	// WindowTimeout, if positive, limits how long a write
+	// waits for the peer to open a stream's send window with
+	// WINDOW_UPDATE. When it expires, the stream is reset and
+	// the write fails. This keeps a peer that never sends
+	// WINDOW_UPDATE from blocking writers forever. If zero,
+	// writes wait as long as it takes.
+	WindowTimeout time.Duration
+
+	// KeepAlive, if positive, is how long s may go without
+	// receiving a frame before it sends PING to check on the
+	// peer. If the peer doesn't echo the PING within KeepAlive
+	// either, s closes the Framer's reader, if it has a Close
+	// method, which stops s with ErrKeepAliveTimeout. Any frame
+	// from the peer counts, so no PING is sent while streams are
+	// busy with data.
+	// Keepalives also keep NAT mappings from expiring.
+	KeepAlive time.Duration
+
+	// StrictHeaders makes s reset, with PROTOCOL_ERROR, any
+	// stream whose SYN_STREAM, SYN_REPLY, or HEADERS has a field
+	// name that isn't lowercase, as SPDY/3 requires. If false,
+	// such names are lowercased and accepted.
+	StrictHeaders bool
+
+	// ReceiveWindow, if positive, is the receive window for
+	// incoming data on each stream: how much the peer may send
+	// before s grants more, and so how much s may buffer. Run
+	// advertises it in SETTINGS before sending anything else.
+	// Values below the SPDY/3 default of 64 KiB are raised to
+	// it, since the peer may send that much before it sees the
+	// SETTINGS frame. It must be less than 1<<31.
+	ReceiveWindow int
+
+	// RawHeaders makes each stream keep the header block
+	// of its SYN_STREAM or SYN_REPLY with the fields in the
+	// order the peer sent them, for Stream.RawHeader. This
+	// is for checks such as request signatures that depend
+	// on the exact header; it's off by default to save memory.
+	RawHeaders bool
+
+	// LogFrame, if non-nil, is called with every frame s
+	// reads or writes, with sent telling which. It's for
+	// debugging; see DumpFrame for a readable form of f.
+	// It runs on whichever goroutine reads or writes the
+	// frame, so it should not block or change f.
+	LogFrame func(f Frame, sent bool)
+
+	// Logf, if non-nil, logs things s notes that aren't
+	// returned as errors, such as the reason given to GoAway.
+	// If nil, they aren't logged.
+	Logf func(format string, args ...interface{})
+
+	// SettingsChanged, if non-nil, is called with a copy of
+	// the peer's settings after each SETTINGS frame from the
+	// peer is applied. It runs on the goroutine that reads
+	// frames, so it should not block.
+	SettingsChanged func(map[SettingsId]uint32)
+
 	fr     *Framer
 	wmu    sync.Mutex
 	openMu sync.Mutex // interlock stream id allocation and SYN_STREAM
 
+	// guarded by wmu
+	bw      *bufio.Writer // nil if unbuffered
+	flushAt *time.Timer   // non-nil while a flush is pending
+
 	rstreams  map[StreamId]*Stream
 	nextSynId StreamId
-	initwnd   int32
+	settings  map[SettingsId]uint32 // as sent by the peer
+	initwnd   int32                 // send window for new streams, set by the peer
+	recvwnd   int32                 // receive window for new streams, set by us
 	closing   bool
+	handlers  int // streams handled or waiting to be
 	mu        sync.RWMutex
 
+	// guarded by mu
+	nextPingId    uint32
+	goingAway     bool                 // GOAWAY sent; no new streams
+	peerGoingAway bool                 // GOAWAY received; no new local streams
+	goAway        *GoAwayFrame         // as sent by the peer
+	lastRecvId    StreamId             // written only by read goroutine
+	pings         map[uint32]chan bool // waiting for the peer to echo
+
+	// Streams we reset recently, so that late frames the peer
+	// sent before it saw our RST_STREAM don't each provoke
+	// another one. Guarded by mu.
+	resetIds [16]StreamId
+	resetPos int
+	resetN   int // entries of resetIds in use
+
 	// accessed only by read goroutine
-	lastRecvId StreamId
-	err        error
+	err error
+
+	closed      int32 // set atomically just before done is closed
+	idleTimeout int64 // time.Duration, accessed atomically
+	lastRecv    int64 // UnixNano of the last frame read, accessed atomically
+	pingTimeout int32 // set when a keepalive PING went unanswered, accessed atomically
+	nrecv       int64 // DATA payload on all streams, accessed atomically
+	nsent       int64 // DATA payload on all streams, accessed atomically
 
 	// not modified
 	isServer bool
 	handle   func(s *Stream)
+	work     chan *Stream // to the handler pool, if MaxHandlers > 0
 	done     chan bool
+	ctlq     chan Frame // see queueCtl
+}
+
+// Start runs a new session on fr in a separate goroutine.
+// See NewSession for the meaning of the parameters.
+func Start(fr *Framer, server bool, handle func(*Stream)) *Session {
+	s := NewSession(fr, server, handle)
+	go s.Run()
+	return s
 }
 
-// Start runs a new session on fr.
+// NewSession returns a new session on fr. Any options
+// should be set before calling Run.
 // If server is true, the session will initiate even-numbered
 // streams and expect odd-numbered streams from the remote
 // endpoint; otherwise the reverse. Func handle is called in
 // a separate goroutine for every incoming stream.
-func Start(fr *Framer, server bool, handle func(*Stream)) *Session {
+func NewSession(fr *Framer, server bool, handle func(*Stream)) *Session {
 	s := &Session{
 		fr:       fr,
 		isServer: server,
 		initwnd:  defaultInitWnd,
+		recvwnd:  defaultInitWnd,
 		rstreams: make(map[StreamId]*Stream),
+		settings: make(map[SettingsId]uint32),
+		pings:    make(map[uint32]chan bool),
 		handle:   handle,
 		done:     make(chan bool),
+		ctlq:     make(chan Frame, 16),
 	}
 	if server {
 		s.nextSynId = 2
+		s.nextPingId = 2
 	} else {
 		s.nextSynId = 1
+		s.nextPingId = 1
 	}
-	go s.read()
 	return s
 }
 
+// Run reads and writes frames on s until the connection
+// fails or the remote endpoint closes it.
+// It returns the same error as Wait.
+func (s *Session) Run() error {
+	if s.WriteBufferSize > 0 || s.WriteFlushInterval > 0 {
+		size := s.WriteBufferSize
+		if size <= 0 {
+			size = defaultWriteBufferSize
+		}
+		s.wmu.Lock()
+		s.bw = bufio.NewWriterSize(s.fr.w, size)
+		s.fr.w = s.bw
+		s.wmu.Unlock()
+	}
+	s.fr.KeepRawHeader(s.RawHeaders)
+	if n := s.ReceiveWindow; n > 0 && int64(n) < 1<<31 {
+		if n < defaultInitWnd {
+			n = defaultInitWnd
+		}
+		s.SetSettings(SettingsFlagIdValue{Id: SettingsInitialWindowSize, Value: uint32(n)})
+	}
+	if s.MaxHandlers > 0 {
+		s.work = make(chan *Stream, s.MaxHandlers+s.HandlerQueue)
+		for i := 0; i < s.MaxHandlers; i++ {
+			go s.serveWork()
+		}
+	}
+	go s.writeCtl()
+	if s.KeepAlive > 0 {
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		go s.keepAlive()
+	}
+	s.read()
+	return s.err
+}
+
 // Wait waits until s stops and returns the error, if any.
+// It returns nil if the peer closed the connection cleanly,
+// between frames. Even then, streams the peer hadn't finished
+// sending on fail to read with io.ErrUnexpectedEOF.
 func (s *Session) Wait() error {
 	<-s.done
 	return s.err
 }
 
+// Closed reports whether s has stopped.
+// Unlike Wait, it does not block.
+func (s *Session) Closed() bool {
+	return atomic.LoadInt32(&s.closed) != 0
+}
+
+// SetIdleTimeout makes s stop if no frame arrives from the
+// peer for d, so that a dead connection that was never closed
+// doesn't linger. It works by setting a read deadline on the
+// Framer's reader, which must have a SetReadDeadline method,
+// as a net.Conn does. The deadline moves forward as each frame
+// arrives. A d of zero turns the timeout off.
+//
+// PING counts as a frame like any other, so if either endpoint
+// sends keepalive PINGs more often than d, s stays open for
+// as long as the peer echoes them.
+func (s *Session) SetIdleTimeout(d time.Duration) error {
+	c, ok := s.fr.r.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return errors.New("reader has no SetReadDeadline method")
+	}
+	atomic.StoreInt64(&s.idleTimeout, int64(d))
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	return c.SetReadDeadline(t)
+}
+
+// setReadDeadline pushes the read deadline forward
+// if there is an idle timeout.
+func (s *Session) setReadDeadline() {
+	d := time.Duration(atomic.LoadInt64(&s.idleTimeout))
+	if d <= 0 {
+		return
+	}
+	if c, ok := s.fr.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		c.SetReadDeadline(time.Now().Add(d))
+	}
+}
+
+// RemoteAddr returns the address of the remote endpoint,
+// if the Framer for s reads directly from a net.Conn
+// (or anything else with a RemoteAddr method).
+// Otherwise it returns nil.
+func (s *Session) RemoteAddr() net.Addr {
+	if c, ok := s.fr.r.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
+// Settings returns a copy of the settings
+// the peer has sent so far.
+func (s *Session) Settings() map[SettingsId]uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.copySettings()
+}
+
+// Setting returns the value the peer has sent for id,
+// such as SettingsRoundTripTime or SettingsDownloadBandwidth.
+// Ok is false if the peer hasn't sent one.
+func (s *Session) Setting(id SettingsId) (v uint32, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok = s.settings[id]
+	return v, ok
+}
+
+func (s *Session) copySettings() map[SettingsId]uint32 {
+	m := make(map[SettingsId]uint32, len(s.settings))
+	for id, v := range s.settings {
+		m[id] = v
+	}
+	return m
+}
+
 func (s *Session) set(id SettingsId, val uint32) {
+	s.settings[id] = val
 	switch id {
 	case SettingsInitialWindowSize:
 		if val < 1<<31 {
@@ -91,12 +396,21 @@ func (s *Session) add(st *Stream) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.closing {
-		return errors.New("closing")
+		return ErrSessionClosing
+	}
+	if s.goingAway || st.id == 0 && s.peerGoingAway {
+		return ErrGoingAway
 	}
 	if st.id == 0 {
 		st.id = s.nextSynId
 		s.nextSynId += 2
 	}
+	// Size the windows here, with s.mu held, so that they
+	// are either current or adjusted by SETTINGS later.
+	st.wnd.n = s.initwnd
+	// The receive buffer grows with the data received,
+	// so streams with little or no body don't pay for all of it.
+	st.pipe.size = int(s.recvwnd)
 	s.rstreams[st.id] = st
 	return nil
 }
@@ -104,22 +418,86 @@ func (s *Session) add(st *Stream) error {
 func (s *Session) maybeRemove(st *Stream) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if st.rclosed && st.wclosed {
+	if r, w := st.closed(); r && w {
 		if st1 := s.rstreams[st.id]; st1 == st {
 			delete(s.rstreams, st.id)
 		}
 	}
 }
 
+// Stats counts the DATA payload bytes carried by a stream
+// or, summed over all its streams, a session. Only payload
+// counts, not frame headers or control frames. Received
+// bytes count as they arrive, whether or not they are read.
+type Stats struct {
+	BytesRecv int64
+	BytesSent int64
+}
+
+// Stats returns the totals for all streams s has carried,
+// including streams that have since closed.
+func (s *Session) Stats() Stats {
+	return Stats{
+		BytesRecv: atomic.LoadInt64(&s.nrecv),
+		BytesSent: atomic.LoadInt64(&s.nsent),
+	}
+}
+
+// StreamInfo describes the state of a stream.
+// See Session.Streams.
+type StreamInfo struct {
+	Id         StreamId
+	Priority   uint8
+	RecvClosed bool
+	SendClosed bool
+	BytesRecv  int64 // DATA payload received
+	BytesSent  int64 // DATA payload sent
+	Age        time.Duration
+}
+
+// Streams returns a snapshot of the active streams in s,
+// ordered by id. It is meant for debugging.
+func (s *Session) Streams() []StreamInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	a := make([]StreamInfo, 0, len(s.rstreams))
+	for _, st := range s.rstreams {
+		r, w := st.closed()
+		a = append(a, StreamInfo{
+			Id:         st.id,
+			Priority:   st.priority,
+			RecvClosed: r,
+			SendClosed: w,
+			BytesRecv:  atomic.LoadInt64(&st.nrecv),
+			BytesSent:  atomic.LoadInt64(&st.nsent),
+			Age:        now.Sub(st.created),
+		})
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Id < a[j].Id })
+	return a
+}
+
+// NumStreams returns the number of streams open in s,
+// in either direction.
+func (s *Session) NumStreams() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.rstreams)
+}
+
 func (s *Session) get(id StreamId) *Stream {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.rstreams[id]
 }
 
-// Run reads and writes frames on s.
+// read reads frames on s and dispatches them.
 func (s *Session) read() {
-	defer close(s.done)
+	defer func() {
+		atomic.StoreInt32(&s.closed, 1)
+		close(s.done)
+	}()
 	defer func() {
 		s.mu.Lock()
 		s.closing = true
@@ -128,22 +506,150 @@ func (s *Session) read() {
 			a[id] = st
 		}
 		s.mu.Unlock()
+		// Even after a clean close, a stream still open for
+		// reading never got FLAG_FIN, so its data is cut short.
+		rerr := errClosed
+		if s.err == nil {
+			rerr = io.ErrUnexpectedEOF
+		}
 		for _, st := range a {
-			st.rclose(errClosed)
-			st.wnd.Close(errClosed)
-			select {
-			case st.reply <- nil:
-			default:
-			}
+			st.rclose(rerr)
+			st.wclose(errClosed)
+		}
+		if s.work != nil {
+			close(s.work)
 		}
 	}()
 	for {
+		s.setReadDeadline()
 		f, err := s.fr.ReadFrame()
+		if s.LogFrame != nil && f != nil {
+			s.LogFrame(f, false)
+		}
+		if err != nil && atomic.LoadInt32(&s.pingTimeout) != 0 {
+			s.err = ErrKeepAliveTimeout
+			return
+		}
+		if isUnlowercased(err) {
+			if s.StrictHeaders {
+				s.protocolError(err.(*Error).StreamId)
+				continue
+			}
+			err = nil
+		}
+		if err == io.EOF {
+			// The peer closed the connection cleanly,
+			// but it may have told us why first.
+			s.mu.RLock()
+			if f := s.goAway; f != nil && f.Status != GoAwayOK {
+				s.err = &GoAwayError{f.LastGoodStreamId, f.Status}
+			}
+			s.mu.RUnlock()
+			return
+		} else if err != nil {
+			s.err = err
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		ok, err := s.checkFlags(f)
 		if err != nil {
 			s.err = err
 			return
 		}
-		s.handleRead(f)
+		if ok {
+			s.handleRead(f)
+		}
+	}
+}
+
+// keepAlive sends PING whenever s has been idle
+// for s.KeepAlive. See the KeepAlive field.
+func (s *Session) keepAlive() {
+	t := time.NewTimer(s.KeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv)))
+		if idle < s.KeepAlive {
+			t.Reset(s.KeepAlive - idle)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.KeepAlive)
+		_, err := s.Ping(ctx)
+		cancel()
+		if err == context.DeadlineExceeded {
+			atomic.StoreInt32(&s.pingTimeout, 1)
+			if c, ok := s.fr.r.(io.Closer); ok {
+				c.Close()
+			}
+			return
+		} else if err != nil {
+			return
+		}
+		t.Reset(s.KeepAlive)
+	}
+}
+
+// Flags defined for each type of frame that the Framer
+// doesn't already check. Other bits are reserved.
+// See SPDY/3 section 2.6. This includes FLAG_COMPRESS
+// on DATA, which we don't implement: better to reset
+// the stream than to pass on compressed bytes as is.
+const (
+	synStreamFlags = ControlFlagFin | ControlFlagUnidirectional
+	synReplyFlags  = ControlFlagFin
+	headersFlags   = ControlFlagFin
+	settingsFlags  = ControlFlagSettingsClearSettings
+	dataFlags      = DataFlagFin
+)
+
+// checkFlags reports whether f has only defined flag bits
+// set. If not, and f belongs to a stream, it resets the
+// stream, and the caller should drop f. If f is SETTINGS,
+// it sends GOAWAY and returns an error, and the caller should
+// stop the session. It lets RST_STREAM pass, since we must
+// not answer it with another RST_STREAM.
+func (s *Session) checkFlags(f Frame) (ok bool, err error) {
+	var id StreamId
+	switch f := f.(type) {
+	case *SynStreamFrame:
+		ok, id = f.CFHeader.Flags&^synStreamFlags == 0, f.StreamId
+	case *SynReplyFrame:
+		ok, id = f.CFHeader.Flags&^synReplyFlags == 0, f.StreamId
+	case *HeadersFrame:
+		ok, id = f.CFHeader.Flags&^headersFlags == 0, f.StreamId
+	case *DataFrame:
+		ok, id = f.Flags&^dataFlags == 0, f.StreamId
+	case *SettingsFrame:
+		if f.CFHeader.Flags&^settingsFlags == 0 {
+			return true, nil
+		}
+		s.writeFrame(&GoAwayFrame{
+			LastGoodStreamId: s.lastRecvId,
+			Status:           GoAwayProtocolError,
+		})
+		return false, &Error{InvalidControlFrame, 0}
+	default:
+		return true, nil
+	}
+	if !ok {
+		s.protocolError(id)
+	}
+	return ok, nil
+}
+
+// protocolError resets stream id with PROTOCOL_ERROR
+// and closes it, if it's open.
+func (s *Session) protocolError(id StreamId) {
+	s.queueReset(id, ProtocolError)
+	if st := s.get(id); st != nil {
+		err := resetError(ProtocolError)
+		st.wclose(err)
+		st.rclose(err)
 	}
 }
 
@@ -153,13 +659,16 @@ func (s *Session) handleRead(f Frame) {
 		s.handleSynStream(f)
 	case *SynReplyFrame:
 		s.handleSynReply(f)
-	//case *RstStreamFrame:
+	case *RstStreamFrame:
+		s.handleRstStream(f)
 	case *SettingsFrame:
 		s.handleSettings(f)
 	case *PingFrame:
-		go s.writeFrame(f)
-	//case *GoAwayFrame:
-	//case *HeadersFrame:
+		s.handlePing(f)
+	case *GoAwayFrame:
+		s.handleGoAway(f)
+	case *HeadersFrame:
+		s.handleHeaders(f)
 	case *WindowUpdateFrame:
 		s.handleWindowUpdate(f)
 	//case *CredentialFrame:
@@ -171,16 +680,31 @@ func (s *Session) handleRead(f Frame) {
 }
 
 func (s *Session) handleSynStream(f *SynStreamFrame) {
+	if s.get(f.StreamId) != nil {
+		// Stream id reuse. See SPDY/3 section 2.3.2.
+		s.protocolError(f.StreamId)
+		return
+	}
 	fromServer := f.StreamId%2 == 0
 	if s.isServer == fromServer || f.StreamId <= s.lastRecvId {
-		go s.reset(f.StreamId, ProtocolError)
+		s.queueReset(f.StreamId, ProtocolError)
 	} else {
+		s.mu.Lock()
 		s.lastRecvId = f.StreamId
+		s.mu.Unlock()
+		if !s.startHandler() {
+			s.queueReset(f.StreamId, RefusedStream)
+			return
+		}
 		st := newStream(s)
 		st.id = f.StreamId
+		st.priority = f.Priority
 		st.header = f.Headers
+		st.hsize = s.fr.HeaderSize()
+		st.raw = s.fr.RawHeader()
 		err := s.add(st)
 		if err != nil {
+			s.endHandler()
 			return
 		}
 		if f.CFHeader.Flags&ControlFlagUnidirectional != 0 {
@@ -189,20 +713,70 @@ func (s *Session) handleSynStream(f *SynStreamFrame) {
 		if f.CFHeader.Flags&ControlFlagFin != 0 {
 			st.rclose(io.EOF)
 		}
-		go s.handle(st)
+		if s.work != nil {
+			s.work <- st // never blocks; see startHandler
+			return
+		}
+		go func() {
+			defer s.endHandler()
+			s.handle(st)
+		}()
+	}
+}
+
+func (s *Session) serveWork() {
+	for st := range s.work {
+		s.handle(st)
+		s.endHandler()
 	}
 }
 
+// startHandler reserves a place for a new stream in the
+// handler pool and its queue. It returns false if there
+// is no room. There is always room if MaxHandlers is zero.
+func (s *Session) startHandler() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxHandlers > 0 && s.handlers >= s.MaxHandlers+s.HandlerQueue {
+		return false
+	}
+	s.handlers++
+	return true
+}
+
+func (s *Session) endHandler() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers--
+}
+
 func (s *Session) handleSynReply(f *SynReplyFrame) {
 	st := s.get(f.StreamId)
 	if st == nil {
-		go s.reset(f.StreamId, InvalidStream)
+		if !s.wasReset(f.StreamId) {
+			s.queueReset(f.StreamId, InvalidStream)
+		}
+		return
+	}
+	if st.replied {
+		// See SPDY/3 section 2.6.2.
+		err := resetError(StreamInUse)
+		s.queueReset(f.StreamId, StreamInUse)
+		st.wclose(err)
+		st.rclose(err)
 		return
 	}
+	st.replied = true
+	st.mu.Lock()
+	st.hsize = s.fr.HeaderSize()
+	st.raw = s.fr.RawHeader()
+	st.mu.Unlock()
 	select {
 	case st.reply <- f.Headers:
 	default:
-		go s.reset(f.StreamId, InvalidStream)
+		// Not a stream we opened, or one that
+		// closed before the reply came.
+		s.queueReset(f.StreamId, InvalidStream)
 		return
 	}
 	if f.CFHeader.Flags&ControlFlagFin != 0 {
@@ -210,12 +784,193 @@ func (s *Session) handleSynReply(f *SynReplyFrame) {
 	}
 }
 
+func (s *Session) handleHeaders(f *HeadersFrame) {
+	if st := s.get(f.StreamId); st != nil {
+		st.handleHeaders(f.Headers, f.CFHeader.Flags)
+		return
+	}
+	s.queueReset(f.StreamId, InvalidStream)
+}
+
+func (s *Session) handleRstStream(f *RstStreamFrame) {
+	if st := s.get(f.StreamId); st != nil {
+		err := resetError(f.Status)
+		st.wclose(err)
+		st.rclose(err)
+	}
+	// Ignore RST_STREAM for streams we've already
+	// forgotten. See SPDY/3 section 2.4.2.
+}
+
+// handleGoAway stops s from opening streams, and fails
+// those it opened that the peer says it won't process.
+// The peer may still open streams of its own.
+// See SPDY/3 section 2.6.6.
+func (s *Session) handleGoAway(f *GoAwayFrame) {
+	s.mu.Lock()
+	s.peerGoingAway = true
+	s.goAway = f
+	var refused []*Stream
+	for id, st := range s.rstreams {
+		if id > f.LastGoodStreamId && st.local() {
+			refused = append(refused, st)
+		}
+	}
+	s.mu.Unlock()
+	for _, st := range refused {
+		st.wclose(ErrGoingAway)
+		st.rclose(ErrGoingAway)
+	}
+}
+
+// GoAway sends GOAWAY with the given status, telling the
+// peer that s will accept no new streams. Streams already
+// open carry on. After GoAway, Open fails, and s ignores
+// SYN_STREAM from the peer.
+//
+// The SPDY/3 GOAWAY frame has no room for anything but a
+// status, so reason, if not empty, is only logged locally
+// with Logf, to help whoever later reads the logs on this
+// side. See SPDY/3 section 2.6.6.
+func (s *Session) GoAway(status GoAwayStatus, reason string) error {
+	s.mu.Lock()
+	s.goingAway = true
+	last := s.lastRecvId
+	s.mu.Unlock()
+	if reason != "" {
+		s.logf("spdy: sending GOAWAY status=%d: %s", status, reason)
+	}
+	return s.writeFrame(&GoAwayFrame{LastGoodStreamId: last, Status: status})
+}
+
+func (s *Session) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
 func (s *Session) handleSettings(f *SettingsFrame) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	prev := s.initwnd
+	if f.CFHeader.Flags&ControlFlagSettingsClearSettings != 0 {
+		s.settings = make(map[SettingsId]uint32)
+	}
 	for _, v := range f.FlagIdValues {
 		s.set(v.Id, v.Value)
 	}
+	delta := s.initwnd - prev
+	var a []*Stream
+	if delta != 0 {
+		for _, st := range s.rstreams {
+			a = append(a, st)
+		}
+	}
+	var m map[SettingsId]uint32
+	if s.SettingsChanged != nil {
+		m = s.copySettings()
+	}
+	s.mu.Unlock()
+	if m != nil {
+		s.SettingsChanged(m)
+	}
+
+	// A new initial window size changes the send window
+	// of open streams too. See SPDY/3 section 2.6.8.
+	for _, st := range a {
+		if err := st.wnd.Adjust(delta); err != nil {
+			s.queueReset(st.id, FlowControlError)
+			st.wclose(errFlowControl)
+			st.rclose(errFlowControl)
+		}
+	}
+}
+
+// Ping sends PING and waits for the peer to echo it.
+// It returns the round-trip time.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	c := make(chan bool, 1)
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return 0, errClosed
+	}
+	id := s.nextPingId
+	s.nextPingId += 2
+	s.pings[id] = c
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	t0 := time.Now()
+	if err := s.writeFrame(&PingFrame{Id: id}); err != nil {
+		return 0, err
+	}
+	select {
+	case <-c:
+		return time.Since(t0), nil
+	case <-s.done:
+		return 0, errClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// SetSettings sends SETTINGS with the given values.
+// If they include SettingsInitialWindowSize, the receive
+// buffers of new and open streams grow to fit the new
+// window before the peer can learn of it.
+func (s *Session) SetSettings(v ...SettingsFlagIdValue) error {
+	var a []*Stream
+	s.mu.Lock()
+	for _, x := range v {
+		if x.Id == SettingsInitialWindowSize && x.Value < 1<<31 && int32(x.Value) > s.recvwnd {
+			s.recvwnd = int32(x.Value)
+			for _, st := range s.rstreams {
+				a = append(a, st)
+			}
+		}
+	}
+	size := s.recvwnd
+	s.mu.Unlock()
+	for _, st := range a {
+		st.pipe.Grow(int(size))
+	}
+	return s.writeFrame(&SettingsFrame{FlagIdValues: v})
+}
+
+// SendRoundTripTime measures the round-trip time to the peer
+// with Ping and sends it in SETTINGS as SettingsRoundTripTime,
+// in milliseconds, to help the peer's congestion control.
+// It returns the measured time.
+func (s *Session) SendRoundTripTime(ctx context.Context) (time.Duration, error) {
+	rtt, err := s.Ping(ctx)
+	if err != nil {
+		return 0, err
+	}
+	err = s.SetSettings(SettingsFlagIdValue{
+		Id:    SettingsRoundTripTime,
+		Value: uint32(rtt / time.Millisecond),
+	})
+	return rtt, err
+}
+
+func (s *Session) handlePing(f *PingFrame) {
+	if (f.Id%2 == 0) != s.isServer {
+		s.queueCtl(f) // echo
+		return
+	}
+	// The peer is echoing one of ours.
+	// Ignore any we didn't send. See SPDY/3 section 2.6.5.
+	s.mu.Lock()
+	c := s.pings[f.Id]
+	delete(s.pings, f.Id)
+	s.mu.Unlock()
+	if c != nil {
+		c <- true
+	}
 }
 
 func (s *Session) handleWindowUpdate(f *WindowUpdateFrame) {
@@ -224,6 +979,10 @@ func (s *Session) handleWindowUpdate(f *WindowUpdateFrame) {
 	}
 	// Ignore WINDOW_UPDATE that comes after we send FLAG_FIN
 	// or any other invalid stream id. See SPDY/3 section 2.6.8.
+	// That includes stream 0, which SPDY/3 doesn't use.
+	// TODO(kr): In SPDY/3.1, stream 0 means the session-level
+	// window, which can be updated at any time, even before the
+	// first stream. We speak only SPDY/3 so far.
 }
 
 func (s *Session) handleData(f *DataFrame) {
@@ -231,25 +990,154 @@ func (s *Session) handleData(f *DataFrame) {
 		st.handleData(f.Data, f.Flags)
 		return
 	}
-	go s.reset(f.StreamId, InvalidStream)
+	if !s.wasReset(f.StreamId) {
+		s.queueReset(f.StreamId, InvalidStream)
+	}
+}
+
+// WriteControlFrame writes f on the session's connection,
+// in turn with the frames s writes itself, and through the
+// same buffer and header compression context. It is for
+// experiments with extensions and for proxies that need to
+// send frames s doesn't produce on its own.
+//
+// S takes no notice of f. The caller is responsible for
+// keeping the session consistent: for example, SYN_STREAM
+// written this way opens no Stream, RST_STREAM leaves the
+// local Stream open, and WINDOW_UPDATE or SETTINGS don't
+// change the windows s keeps. Frames that break the protocol
+// may cause the peer to reset streams or end the session.
+func (s *Session) WriteControlFrame(f Frame) error {
+	return s.writeFrame(f)
 }
 
 func (s *Session) writeFrame(f Frame) error {
+	return s.writeFrames(f)
+}
+
+// writeFrames writes a batch of frames together,
+// so that they need at most one flush.
+func (s *Session) writeFrames(fs ...Frame) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	for _, f := range fs {
+		if err := s.fr.WriteFrame(f); err != nil {
+			return err
+		}
+		if s.LogFrame != nil {
+			s.LogFrame(f, true)
+		}
+	}
+	if s.bw == nil {
+		return nil
+	}
+	if s.WriteFlushInterval <= 0 {
+		return s.bw.Flush()
+	}
+	if s.flushAt == nil {
+		s.flushAt = time.AfterFunc(s.WriteFlushInterval, s.flush)
+	}
+	return nil
+}
+
+// flush writes out any buffered frames
+// once WriteFlushInterval has elapsed.
+func (s *Session) flush() {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.flushAt = nil
+	s.bw.Flush()
+}
+
+// flushNow writes out any buffered frames right away,
+// without waiting for WriteFlushInterval.
+func (s *Session) flushNow() error {
 	s.wmu.Lock()
 	defer s.wmu.Unlock()
-	return s.fr.WriteFrame(f)
+	if s.bw == nil {
+		return nil
+	}
+	if s.flushAt != nil {
+		s.flushAt.Stop()
+		s.flushAt = nil
+	}
+	return s.bw.Flush()
+}
+
+// queueCtl arranges for f to be written by the control writer
+// goroutine. The read goroutine uses it for the frames it sends
+// in response to the peer, so that it neither waits on other
+// writers nor starts a goroutine for every frame. The queue is
+// bounded; if it fills up, queueCtl blocks, and we stop reading
+// frames until the peer catches up.
+func (s *Session) queueCtl(f Frame) {
+	select {
+	case s.ctlq <- f:
+	case <-s.done:
+	}
 }
 
-func (s *Session) reset(id StreamId, status RstStreamStatus) error {
-	return s.writeFrame(&RstStreamFrame{StreamId: id, Status: status})
+func (s *Session) writeCtl() {
+	var batch []Frame
+	for {
+		select {
+		case f := <-s.ctlq:
+			// Take whatever else is waiting, too.
+			batch = append(batch[:0], f)
+			for n := len(s.ctlq); n > 0; n-- {
+				batch = append(batch, <-s.ctlq)
+			}
+			s.writeFrames(batch...)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// queueReset sends RST_STREAM for id using queueCtl.
+// It is for use on the read goroutine.
+func (s *Session) queueReset(id StreamId, status RstStreamStatus) {
+	s.noteReset(id)
+	s.queueCtl(&RstStreamFrame{StreamId: id, Status: status})
+}
+
+func (s *Session) noteReset(id StreamId) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resetIds[s.resetPos] = id
+	s.resetPos = (s.resetPos + 1) % len(s.resetIds)
+	if s.resetN < len(s.resetIds) {
+		s.resetN++
+	}
+}
+
+// wasReset reports whether we recently sent RST_STREAM for id.
+func (s *Session) wasReset(id StreamId) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, x := range s.resetIds[:s.resetN] {
+		if x == id {
+			return true
+		}
+	}
+	return false
 }
 
 // Open initiates a new SPDY stream with SYN_STREAM.
 // Flags invalid for SYN_STREAM will be silently ignored.
+// If the session has stopped, Open returns ErrSessionClosing,
+// and once either endpoint has sent GOAWAY, ErrGoingAway.
 func (s *Session) Open(h http.Header, flag ControlFlags) (*Stream, error) {
 	st := newStream(s)
 	st.wready = true
 
+	// The read goroutine can find st as soon as add returns,
+	// and the peer may reply right away, so the reply channel
+	// must be in place before then.
+	if flag&ControlFlagUnidirectional == 0 {
+		st.reply = make(chan http.Header, 1)
+	}
+
 	// Avoid a race between calls to writeFrame, below.
 	// Once add returns, we've assigned the stream id,
 	// so don't send them out of order.
@@ -262,8 +1150,6 @@ func (s *Session) Open(h http.Header, flag ControlFlags) (*Stream, error) {
 	}
 	if flag&ControlFlagUnidirectional != 0 {
 		st.rclose(errNotReadable)
-	} else {
-		st.reply = make(chan http.Header, 1)
 	}
 	if flag&ControlFlagFin != 0 {
 		st.wclose(errNotWritable)
@@ -285,52 +1171,148 @@ type Stream struct {
 	id   StreamId
 	sess *Session
 
-	pipe    pipe // incoming data
+	// mu guards rclosed, rerr, wclosed, werr, wready, discard,
+	// unacked, hsize, and raw. If both s.mu and sess.mu are needed, sess.mu must
+	// be acquired first. The read goroutine sets header before other
+	// goroutines can see s, or else hands it over on reply.
+	mu      sync.Mutex
 	rclosed bool
-
-	wready  bool
-	wnd     semaphore // send window size
+	rerr    error // why s was closed for reading
 	wclosed bool
+	werr    error         // why s was closed for writing
+	wready  bool          // SYN_STREAM or SYN_REPLY sent
+	discard bool          // incoming data is dropped; see CloseRead
+	unacked int           // bytes read but not yet in a WINDOW_UPDATE
+	done    chan struct{} // closed when rclosed and wclosed are both set
+
+	pipe    pipe        // incoming data
+	wnd     semaphore   // send window size
 	header  http.Header // incoming header (SYN_STREAM or SYN_REPLY)
 	reply   chan http.Header
+	hOnce   sync.Once // receives header from reply
+	hsize   HeaderSize
+	raw     []HeaderField // header fields as sent, if Session.RawHeaders
+	replied bool          // SYN_REPLY received; accessed only by read goroutine
+
+	// for debugging; see Session.Streams
+	priority uint8
+	created  time.Time
+	nrecv    int64 // accessed atomically
+	nsent    int64 // accessed atomically
 
-	// TODO(kr): unimplemented
 	// Trailer will be filled in by HEADERS frames received during
 	// the stream. Once the stream is closed for receiving, Trailer
 	// is complete and won't be written to again.
-	//Trailer http.Header
+	Trailer http.Header
 }
 
 func newStream(sess *Session) *Stream {
-	s := &Stream{sess: sess}
-	s.pipe.b.buf = make([]byte, defaultInitWnd)
+	s := &Stream{
+		sess:    sess,
+		done:    make(chan struct{}),
+		Trailer: make(http.Header),
+		created: time.Now(),
+	}
 	s.pipe.c.L = &s.pipe.m
-	sess.mu.RLock()
-	s.wnd.n = sess.initwnd
-	sess.mu.RUnlock()
 	s.wnd.c.L = &s.wnd.m
 	return s
 }
 
+// Id returns the stream id of s.
+func (s *Stream) Id() StreamId {
+	return s.id
+}
+
+// Session returns the session s belongs to.
+func (s *Stream) Session() *Session {
+	return s.sess
+}
+
+// Done returns a channel that's closed when s is closed
+// in both directions. This happens when either endpoint
+// resets s, when the session stops, or when both endpoints
+// have sent FLAG_FIN.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
 // Incoming header, from either SYN_STREAM or SYN_REPLY.
 // Returns nil if there is no incoming direction (either
 // because s is unidirectional, or because of an error).
 func (s *Stream) Header() http.Header {
-	if s.reply != nil {
-		s.header = <-s.reply
-		s.reply = nil
+	// Only a stream we opened waits for SYN_REPLY.
+	// One opened by the remote endpoint got its header
+	// from SYN_STREAM, and nothing will arrive on s.reply.
+	if s.reply != nil && s.local() {
+		s.hOnce.Do(func() { s.header = <-s.reply })
 	}
 	return s.header
 }
 
+// Err returns the error that closed s for reading: io.EOF
+// after the peer's FLAG_FIN, ErrGoingAway if the peer's GOAWAY
+// refused s, or another error if s was reset or the session
+// stopped. If s is reset after the peer's FLAG_FIN, while it
+// is still open for writing, Err returns the reset error
+// instead of io.EOF. It returns nil while s is open for reading.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.werr.(resetError); ok && s.rerr == io.EOF {
+		return s.werr
+	}
+	return s.rerr
+}
+
+// Stats returns the counts for s so far. It is safe
+// to call at any time, from any goroutine, so that
+// middleware can report on a stream without wrapping it.
+func (s *Stream) Stats() Stats {
+	return Stats{
+		BytesRecv: atomic.LoadInt64(&s.nrecv),
+		BytesSent: atomic.LoadInt64(&s.nsent),
+	}
+}
+
+// HeaderSize returns the size of the header block
+// returned by Header. It is valid once Header returns.
+func (s *Stream) HeaderSize() HeaderSize {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hsize
+}
+
+// RawHeader returns the fields of the header block returned
+// by Header, in the order the peer sent them, with names and
+// values as they were on the wire. It returns nil unless the
+// session's RawHeaders is set. It is valid once Header returns.
+func (s *Stream) RawHeader() []HeaderField {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.raw
+}
+
+// local reports whether s was initiated by the local endpoint.
+func (s *Stream) local() bool {
+	return (s.id%2 == 0) == s.sess.isServer
+}
+
 // Reply sends SYN_REPLY with header fields from h.
 // It is an error to call Reply twice or to call
 // Reply on a stream initiated by the local endpoint.
 func (s *Stream) Reply(h http.Header, flag ControlFlags) error {
-	if s.wready {
+	s.mu.Lock()
+	ready, closed := s.wready, s.wclosed
+	s.wready = true
+	s.mu.Unlock()
+	if ready {
 		return errCannotReply
 	}
-	s.wready = true
+	if closed {
+		// Reset, or unidirectional. Either way,
+		// SYN_REPLY would be a protocol error.
+		return errClosed
+	}
 	if flag&ControlFlagFin != 0 {
 		defer s.wclose(errClosed)
 	}
@@ -339,13 +1321,129 @@ func (s *Stream) Reply(h http.Header, flag ControlFlags) error {
 	return s.sess.writeFrame(f)
 }
 
+// SendHeaders sends HEADERS with header fields from h.
+// If flag has ControlFlagFin set, this shuts down the writing
+// side of s, so the header fields become the stream's trailer.
+// It is an error to call SendHeaders before calling Reply on a
+// stream initiated by the remote endpoint.
+func (s *Stream) SendHeaders(h http.Header, flag ControlFlags) error {
+	if err := s.writable(); err != nil {
+		return err
+	}
+	if flag&ControlFlagFin != 0 {
+		defer s.wclose(errClosed)
+	}
+	f := &HeadersFrame{StreamId: s.id, Headers: h}
+	f.CFHeader.Flags = flag & ControlFlagFin
+	return s.sess.writeFrame(f)
+}
+
 // Read reads the contents of DATA frames received on s.
 func (s *Stream) Read(p []byte) (n int, err error) {
 	n, err = s.pipe.Read(p)
-	s.updateWindow(uint32(n))
+	s.consumed(n)
 	return n, err
 }
 
+// ReadFrame reads the payload of the next DATA frame
+// received on s. Unlike Read, it preserves the boundaries
+// between frames, for protocols that carry messages in them,
+// but it allocates a new slice for each frame. Empty frames
+// are skipped. Fin reports whether the peer has finished
+// sending; at that point, err is nil if p is non-empty and
+// io.EOF otherwise.
+//
+// It is okay to mix calls to Read and ReadFrame. If Read
+// consumes part of a frame, ReadFrame returns the rest.
+func (s *Stream) ReadFrame() (p []byte, fin bool, err error) {
+	p, fin, err = s.pipe.ReadChunk()
+	s.consumed(len(p))
+	return p, fin, err
+}
+
+// Discard reads and drops the rest of the data on s until
+// the peer finishes sending, returning nil at EOF or any other
+// error encountered. Unlike CloseRead, it waits for the
+// peer to finish and reports how the stream ended; unlike
+// copying to ioutil.Discard, it drops everything buffered
+// at once, without copying it.
+func (s *Stream) Discard() error {
+	for {
+		n, err := s.pipe.Skip()
+		s.consumed(n)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// CloseRead stops reading from s. It drops any unread data
+// and frees the receive buffer, and data that arrives later
+// is dropped too. Future calls to Read return an error.
+// The writing side of s is unaffected.
+//
+// SPDY/3 has no way to tell the peer to stop sending,
+// short of RST_STREAM, which would close both directions.
+// Instead, s goes on granting window for the data it drops,
+// as if it had been read, so the peer isn't left stalled
+// with a full window. The peer must still stay within the
+// window; if it doesn't, s is reset with FLOW_CONTROL_ERROR.
+func (s *Stream) CloseRead() error {
+	s.mu.Lock()
+	s.discard = true
+	s.mu.Unlock()
+	s.consumed(s.pipe.Discard(errReadClosed))
+	return nil
+}
+
+func (s *Stream) discarding() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.discard
+}
+
+// drop accounts for n bytes of DATA that arrived after
+// CloseRead. Nothing is buffered by then, so the data
+// the peer has sent but hasn't had window for again is
+// just s.unacked. Drop reports false if n would exceed
+// the receive window.
+func (s *Stream) drop(n int) bool {
+	size := s.pipe.Size()
+	s.mu.Lock()
+	over := s.unacked+n > size
+	s.mu.Unlock()
+	if over {
+		return false
+	}
+	s.consumed(n)
+	return true
+}
+
+// consumed records that n bytes have been read from s.
+// Rather than send a WINDOW_UPDATE for every read, it waits
+// until the reads add up to half the receive window. That
+// always leaves the peer at least half a window to send into,
+// so the stream doesn't stall, and small reads don't turn
+// into a storm of tiny WINDOW_UPDATE frames.
+func (s *Stream) consumed(n int) {
+	if n < 1 {
+		return
+	}
+	size := s.pipe.Size()
+	s.mu.Lock()
+	s.unacked += n
+	delta := s.unacked
+	if delta < size/2 {
+		s.mu.Unlock()
+		return
+	}
+	s.unacked = 0
+	s.mu.Unlock()
+	s.updateWindow(uint32(delta))
+}
+
 func (s *Stream) updateWindow(delta uint32) error {
 	if delta < 1 || delta > 1<<31-1 {
 		return fmt.Errorf("window delta out of range: %d", delta)
@@ -359,32 +1457,119 @@ func (s *Stream) updateWindow(delta uint32) error {
 // Write writes p as the contents of one or more DATA frames.
 // It is an error to call Write before calling Reply on a stream
 // initiated by the remote endpoint.
+// A Write of zero bytes does nothing and returns 0, nil:
+// it sends no DATA frame, so it neither uses any of the send
+// window nor flushes anything. Use Close to send FLAG_FIN.
 func (s *Stream) Write(p []byte) (n int, err error) {
 	for n < len(p) && err == nil {
 		var c int
-		c, err = s.writeData(p[n:])
+		c, err = s.writeData(p[n:], false)
 		n += c
 	}
 	return n, err
 }
 
+// WriteClose is like Write followed by Close, but it sets
+// FLAG_FIN on the last DATA frame holding p rather than
+// sending an empty one after it. If p is empty, it is
+// the same as Close.
+func (s *Stream) WriteClose(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, s.Close()
+	}
+	for n < len(p) && err == nil {
+		var c int
+		c, err = s.writeData(p[n:], true)
+		n += c
+	}
+	return n, err
+}
+
+// WriteString is like Write, but it copies str into DATA
+// frames through a reused buffer instead of converting all
+// of it to a byte slice at once.
+func (s *Stream) WriteString(str string) (n int, err error) {
+	if len(str) <= smallWrite {
+		return s.Write([]byte(str))
+	}
+	bp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bp)
+	for n < len(str) && err == nil {
+		var c int
+		c, err = s.Write((*bp)[:copy(*bp, str[n:])])
+		n += c
+	}
+	return n, err
+}
+
+// ReadFrom reads data from r until EOF and writes it to s,
+// as Write does, in DATA frames sized to the send window.
+// It reads into a buffer reused from one call to the next,
+// which makes io.Copy to s cheaper than going through Write.
+// The return value n is the number of bytes written.
+// Any error except io.EOF encountered during the read is
+// also returned.
+func (s *Stream) ReadFrom(r io.Reader) (n int64, err error) {
+	bp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bp)
+	for {
+		m, rerr := r.Read(*bp)
+		if m > 0 {
+			w, err := s.Write((*bp)[:m])
+			n += int64(w)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		} else if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// Writes of at most smallWrite bytes
+// aren't worth the trip through copyBufPool.
+const smallWrite = 512
+
+// Buffers for ReadFrom and WriteString,
+// the same size io.Copy would allocate.
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32<<10)
+		return &b
+	},
+}
+
 // writeData writes a single DATA frame containing bytes from p.
-func (s *Stream) writeData(p []byte) (int, error) {
-	if s.wclosed {
-		return 0, errClosed
+// If fin is set and the frame holds all of p, it has FLAG_FIN,
+// and s is closed for writing.
+func (s *Stream) writeData(p []byte, fin bool) (int, error) {
+	if err := s.writable(); err != nil {
+		return 0, err
 	}
-	if !s.wready {
-		return 0, errNotWritable
+	n, err := s.wnd.DecTimeout(int32(len(p)), s.sess.WindowTimeout)
+	if err == errSemaphoreTimeout {
+		s.sess.logf("spdy: stream %d: no WINDOW_UPDATE after %v, resetting", s.id, s.sess.WindowTimeout)
+		s.Reset(Cancel)
+		return 0, errWindowTimeout
 	}
-	n, err := s.wnd.Dec(int32(len(p)))
 	if err != nil {
 		s.Reset(InternalError)
 		return 0, err
 	}
-	err = s.sess.writeFrame(&DataFrame{StreamId: s.id, Data: p[:n]})
+	f := &DataFrame{StreamId: s.id, Data: p[:n]}
+	if fin && int(n) == len(p) {
+		f.Flags = DataFlagFin
+		defer s.wclose(errClosed)
+	}
+	err = s.sess.writeFrame(f)
 	if err != nil {
 		return 0, err
 	}
+	atomic.AddInt64(&s.nsent, int64(n))
+	atomic.AddInt64(&s.sess.nsent, int64(n))
 	return int(n), nil
 }
 
@@ -394,55 +1579,164 @@ func (s *Stream) writeData(p []byte) (int, error) {
 // It is an error to call Close before calling Reply on a stream
 // initiated by the remote endpoint.
 func (s *Stream) Close() error {
-	if s.wclosed {
-		return errClosed
-	}
-	if !s.wready {
-		return errNotWritable
+	if err := s.writable(); err != nil {
+		return err
 	}
 	defer s.wclose(errClosed)
 	return s.sess.writeFrame(&DataFrame{StreamId: s.id, Flags: DataFlagFin})
 }
 
+// Flush sends any data written to s that is still waiting
+// in the session's write buffer, without closing s for
+// writing. Other frames in the buffer go with it. Flush
+// matters only if the session buffers writes for a while;
+// see WriteFlushInterval. Otherwise, Write sends at once.
+func (s *Stream) Flush() error {
+	return s.sess.flushNow()
+}
+
 // Reset sends RST_STREAM, closing the stream and indicating
 // an error condition.
 func (s *Stream) Reset(status RstStreamStatus) error {
-	defer s.wclose(resetError(status))
-	defer s.rclose(resetError(status))
-	return s.sess.reset(s.id, status)
+	// Close s before sending RST_STREAM, so that nothing
+	// the peer sends in response can be delivered on s.
+	s.sess.noteReset(s.id)
+	err := resetError(status)
+	s.wclose(err)
+	s.rclose(err)
+	return s.sess.writeFrame(&RstStreamFrame{StreamId: s.id, Status: status})
 }
 
 func (s *Stream) handleWindowUpdate(delta int32) {
 	if err := s.wnd.Inc(delta); err != nil {
-		s.sess.reset(s.id, FlowControlError)
+		s.sess.queueReset(s.id, FlowControlError)
 		s.wnd.Close(errFlowControl)
 		s.rclose(errFlowControl)
 	}
 }
 
 func (s *Stream) handleData(p []byte, flag DataFlags) {
-	if s.rclosed {
-		go s.sess.reset(s.id, StreamAlreadyClosed)
+	if r, _ := s.closed(); r {
+		// DATA after FLAG_FIN. See SPDY/3 section 2.3.6.
+		// Reset the stream once, closing it for writing first
+		// so the handler can't send anything after RST_STREAM.
+		// Stray frames that come after are dropped.
+		if !s.sess.wasReset(s.id) {
+			s.wclose(resetError(StreamAlreadyClosed))
+			s.sess.queueReset(s.id, StreamAlreadyClosed)
+		}
 		return
 	}
-	switch _, err := s.pipe.Write(p); {
-	case err != nil:
-		s.wnd.Close(errFlowControl)
-		s.rclose(errFlowControl)
-		s.sess.reset(s.id, FlowControlError)
-	case flag&DataFlagFin != 0:
+	if s.reply != nil && s.local() && !s.replied {
+		// DATA must not come before SYN_REPLY.
+		// See SPDY/3 section 2.2.2.
+		err := resetError(ProtocolError)
+		s.sess.queueReset(s.id, ProtocolError)
+		s.wclose(err)
+		s.rclose(err)
+		return
+	}
+	atomic.AddInt64(&s.nrecv, int64(len(p)))
+	atomic.AddInt64(&s.sess.nrecv, int64(len(p)))
+	if !s.discarding() {
+		_, err := s.pipe.Write(p)
+		if err == nil {
+			if flag&DataFlagFin != 0 {
+				s.rclose(io.EOF)
+			}
+			return
+		}
+		if !s.discarding() {
+			s.flowControlError()
+			return
+		}
+		// CloseRead closed the pipe just now.
+	}
+	if !s.drop(len(p)) {
+		s.flowControlError()
+		return
+	}
+	if flag&DataFlagFin != 0 {
 		s.rclose(io.EOF)
 	}
 }
 
+// flowControlError resets s for DATA beyond its receive window.
+func (s *Stream) flowControlError() {
+	s.wnd.Close(errFlowControl)
+	s.rclose(errFlowControl)
+	s.sess.queueReset(s.id, FlowControlError)
+}
+
+func (s *Stream) handleHeaders(h http.Header, flag ControlFlags) {
+	if r, _ := s.closed(); r {
+		if !s.sess.wasReset(s.id) {
+			s.sess.queueReset(s.id, StreamAlreadyClosed)
+		}
+		return
+	}
+	for k, vv := range h {
+		s.Trailer[k] = append(s.Trailer[k], vv...)
+	}
+	if flag&ControlFlagFin != 0 {
+		s.rclose(io.EOF)
+	}
+}
+
+// writable returns an error if s can't send DATA or
+// HEADERS, either because it is closed for writing or
+// because it is waiting for a call to Reply.
+func (s *Stream) writable() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wclosed {
+		return errClosed
+	}
+	if !s.wready {
+		return errNotWritable
+	}
+	return nil
+}
+
+// closed reports whether s is closed
+// for reading and for writing.
+func (s *Stream) closed() (r, w bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rclosed, s.wclosed
+}
+
 func (s *Stream) rclose(err error) {
-	s.rclosed = true
+	s.mu.Lock()
+	if !s.rclosed {
+		s.rclosed = true
+		s.rerr = err
+		if s.wclosed {
+			close(s.done)
+		}
+	}
+	s.mu.Unlock()
 	s.pipe.Close(err)
+	if s.reply != nil {
+		// Unblock Header if SYN_REPLY hasn't come.
+		select {
+		case s.reply <- nil:
+		default:
+		}
+	}
 	s.sess.maybeRemove(s)
 }
 
 func (s *Stream) wclose(err error) {
-	s.wclosed = true
+	s.mu.Lock()
+	if !s.wclosed {
+		s.wclosed = true
+		s.werr = err
+		if s.rclosed {
+			close(s.done)
+		}
+	}
+	s.mu.Unlock()
 	s.wnd.Close(err)
 	s.sess.maybeRemove(s)
 }
@@ -1,12 +1,22 @@
 package spdyframing
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var sessionTests = []struct {
@@ -18,7 +28,7 @@ var sessionTests = []struct {
 	{
 		handler:  failHandler,
 		frames:   []Frame{},
-		wSessErr: io.EOF,
+		wSessErr: nil,
 	},
 	{
 		handler: echoHandler,
@@ -39,7 +49,7 @@ var sessionTests = []struct {
 				Data:     []byte{},
 			},
 		},
-		wSessErr:    io.EOF,
+		wSessErr:    nil,
 		wHandlerErr: []bool{false},
 	},
 	{
@@ -58,11 +68,6 @@ var sessionTests = []struct {
 				Flags:    DataFlagFin,
 				Data:     []byte{0, 1, 2},
 			},
-			&WindowUpdateFrame{
-				StreamId:        1,
-				DeltaWindowSize: 3,
-			},
-			nil,
 			&DataFrame{
 				StreamId: 1,
 				Data:     []byte{0, 1, 2},
@@ -74,7 +79,7 @@ var sessionTests = []struct {
 				Data:     []byte{},
 			},
 		},
-		wSessErr:    io.EOF,
+		wSessErr:    nil,
 		wHandlerErr: []bool{false},
 	},
 	{
@@ -100,11 +105,6 @@ var sessionTests = []struct {
 				Flags:    DataFlagFin,
 				Data:     []byte{0, 1, 2},
 			},
-			&WindowUpdateFrame{
-				StreamId:        1,
-				DeltaWindowSize: 3,
-			},
-			nil,
 			&DataFrame{
 				StreamId: 1,
 				Data:     []byte{0},
@@ -132,7 +132,7 @@ var sessionTests = []struct {
 				Data:     []byte{},
 			},
 		},
-		wSessErr:    io.EOF,
+		wSessErr:    nil,
 		wHandlerErr: []bool{false},
 	},
 	{
@@ -141,7 +141,7 @@ var sessionTests = []struct {
 			&PingFrame{Id: 1},
 			&PingFrame{Id: 1},
 		},
-		wSessErr: io.EOF,
+		wSessErr: nil,
 	},
 	{
 		handler: failHandler,
@@ -149,7 +149,35 @@ var sessionTests = []struct {
 			&DataFrame{StreamId: 1, Flags: DataFlagFin},
 			&RstStreamFrame{StreamId: 1, Status: InvalidStream},
 		},
-		wSessErr: io.EOF,
+		wSessErr: nil,
+	},
+	{
+		handler: failHandler,
+		frames: []Frame{
+			&SynStreamFrame{
+				StreamId: 1,
+				CFHeader: ControlFrameHeader{Flags: 0x04},
+				Headers:  http.Header{"X": {"y"}},
+			},
+			&RstStreamFrame{StreamId: 1, Status: ProtocolError},
+		},
+		wSessErr: nil,
+	},
+	{
+		handler: failHandler,
+		frames: []Frame{
+			&DataFrame{StreamId: 1, Flags: 0x80},
+			&RstStreamFrame{StreamId: 1, Status: ProtocolError},
+		},
+		wSessErr: nil,
+	},
+	{
+		handler: failHandler,
+		frames: []Frame{
+			&DataFrame{StreamId: 1, Flags: DataFlagCompress, Data: []byte("x")},
+			&RstStreamFrame{StreamId: 1, Status: ProtocolError},
+		},
+		wSessErr: nil,
 	},
 	{
 		handler: echoHandler,
@@ -171,7 +199,7 @@ var sessionTests = []struct {
 				Status:   FlowControlError,
 			},
 		},
-		wSessErr:    io.EOF,
+		wSessErr:    nil,
 		wHandlerErr: []bool{true},
 	},
 	{
@@ -194,9 +222,48 @@ var sessionTests = []struct {
 				Status:   FlowControlError,
 			},
 		},
-		wSessErr:    io.EOF,
+		wSessErr:    nil,
 		wHandlerErr: []bool{true},
 	},
+	{
+		// Late DATA on a stream we reset gets no more resets.
+		handler: resetHandler,
+		frames: []Frame{
+			&SynStreamFrame{
+				StreamId: 1,
+				Headers:  http.Header{"X": {"y"}},
+			},
+			&RstStreamFrame{
+				StreamId: 1,
+				Status:   Cancel,
+			},
+			&DataFrame{StreamId: 1, Data: []byte{0}},
+			nil,
+			&DataFrame{StreamId: 1, Data: []byte{1}, Flags: DataFlagFin},
+			nil,
+			&PingFrame{Id: 1},
+			&PingFrame{Id: 1},
+		},
+		wSessErr:    nil,
+		wHandlerErr: []bool{false},
+	},
+	{
+		handler: headerHandler,
+		frames: []Frame{
+			&SynStreamFrame{
+				StreamId: 1,
+				CFHeader: ControlFrameHeader{Flags: ControlFlagFin},
+				Headers:  http.Header{"X": {"y"}},
+			},
+			&SynReplyFrame{
+				StreamId: 1,
+				CFHeader: ControlFrameHeader{Flags: ControlFlagFin},
+				Headers:  http.Header{"X": {"y"}},
+			},
+		},
+		wSessErr:    nil,
+		wHandlerErr: []bool{false},
+	},
 }
 
 func failHandler(t *testing.T, st *Stream) error {
@@ -204,6 +271,46 @@ func failHandler(t *testing.T, st *Stream) error {
 	return nil
 }
 
+func resetHandler(t *testing.T, st *Stream) error {
+	return st.Reset(Cancel)
+}
+
+// headerHandler checks that Header on a stream opened by the
+// remote endpoint returns right away, since no SYN_REPLY will
+// ever arrive for it. See also TestStreamHeaderRemote.
+func headerHandler(t *testing.T, st *Stream) error {
+	c := make(chan http.Header, 1)
+	go func() { c <- st.Header() }()
+	select {
+	case h := <-c:
+		return st.Reply(h, ControlFlagFin)
+	case <-time.After(time.Second):
+		st.Reset(InternalError)
+		return errors.New("Header blocked")
+	}
+}
+
+// Header on a stream the remote endpoint opened doesn't wait
+// for SYN_REPLY, even if the stream has a reply channel.
+// The stream is built here, before any other goroutine can
+// see it, rather than changed under a running session.
+func TestStreamHeaderRemote(t *testing.T) {
+	st := newStream(&Session{isServer: true})
+	st.id = 1
+	st.header = http.Header{"X": {"y"}}
+	st.reply = make(chan http.Header, 1)
+	c := make(chan http.Header, 1)
+	go func() { c <- st.Header() }()
+	select {
+	case h := <-c:
+		if !reflect.DeepEqual(h, st.header) {
+			t.Errorf("Header = %v want %v", h, st.header)
+		}
+	case <-time.After(time.Second):
+		t.Error("Header blocked")
+	}
+}
+
 func echoHandler(t *testing.T, st *Stream) error {
 	err := st.Reply(st.Header(), 0)
 	if err != nil {
@@ -269,8 +376,6 @@ func TestSessionClient(t *testing.T) {
 		&SynStreamFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}},
 		&DataFrame{StreamId: 1, Data: []byte("foo")},
 		&DataFrame{StreamId: 1, Data: []byte{}, Flags: DataFlagFin},
-		// The client also sends a WindowUpdateFrame here, but the test
-		// harness server doesn't stick around long enough to read it.
 	}
 
 	reply := []Frame{
@@ -344,78 +449,2139 @@ func TestSessionClient(t *testing.T) {
 	}
 }
 
-func TestSessionUnidirectional(t *testing.T) {
-	var flags ControlFlags = ControlFlagUnidirectional
-	got := make(chan []Frame, 1)
-	want := []Frame{
+func TestSessionHeaderSize(t *testing.T) {
+	h := http.Header{":method": {"GET"}, ":path": {"/"}, "Accept": {"*/*"}}
+	var block bytes.Buffer
+	writeHeaderValueBlock(&block, h)
+
+	c, s := pipeConn()
+	got := make(chan HeaderSize, 1)
+	sess := Start(NewFramer(s, s), true, func(st *Stream) {
+		got <- st.HeaderSize()
+		st.Reset(Cancel)
+	})
+	go io.Copy(ioutil.Discard, c)
+	cfr := NewFramer(c, c)
+	err := cfr.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := <-got
+	if hs.Decoded != int64(block.Len()) {
+		t.Errorf("Decoded = %d want %d", hs.Decoded, block.Len())
+	}
+	if hs.Wire <= 0 || hs.Wire > hs.Decoded+64 {
+		t.Errorf("Wire = %d, implausible for %d bytes decoded", hs.Wire, hs.Decoded)
+	}
+	c.Close()
+	sess.Wait()
+	s.Close()
+}
+
+func TestSessionMaxHandlers(t *testing.T) {
+	const max, n = 2, 10
+	c, s := pipeConn()
+	release := make(chan bool)
+	started := make(chan bool, n)
+	sess := NewSession(NewFramer(s, s), true, func(st *Stream) {
+		started <- true
+		<-release
+		st.Reset(Cancel)
+	})
+	sess.MaxHandlers = max
+	go sess.Run()
+	cfr := NewFramer(c, c)
+	go func() {
+		for i := 0; i < n; i++ {
+			f := &SynStreamFrame{StreamId: StreamId(2*i + 1), Headers: http.Header{"X": {"y"}}}
+			if err := cfr.WriteFrame(f); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := max; i < n; i++ {
+		f, err := cfr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &RstStreamFrame{StreamId: StreamId(2*i + 1), Status: RefusedStream}
+		pubdiff(t, fmt.Sprintf("#%d", i), f, want)
+	}
+	for i := 0; i < max; i++ {
+		<-started
+	}
+	select {
+	case <-started:
+		t.Errorf("more than %d handlers started", max)
+	default:
+	}
+	go io.Copy(ioutil.Discard, c)
+	close(release)
+	c.Close()
+	sess.Wait()
+	s.Close()
+}
+
+func TestSessionHandlerQueue(t *testing.T) {
+	for _, max := range []int{1, 2} {
+		const queue, n = 3, 10
+		c, s := pipeConn()
+		release := make(chan bool)
+		done := make(chan StreamId, n)
+		var running, maxRunning int32
+		sess := NewSession(NewFramer(s, s), true, func(st *Stream) {
+			r := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if r <= m || atomic.CompareAndSwapInt32(&maxRunning, m, r) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+			st.Reset(Cancel)
+			done <- st.Id()
+		})
+		sess.MaxHandlers = max
+		sess.HandlerQueue = queue
+		go sess.Run()
+		cfr := NewFramer(c, c)
+		go func() {
+			for i := 0; i < n; i++ {
+				f := &SynStreamFrame{StreamId: StreamId(2*i + 1), Headers: http.Header{"X": {"y"}}}
+				if err := cfr.WriteFrame(f); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		for i := max + queue; i < n; i++ {
+			f, err := cfr.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := &RstStreamFrame{StreamId: StreamId(2*i + 1), Status: RefusedStream}
+			pubdiff(t, fmt.Sprintf("max %d #%d", max, i), f, want)
+		}
+		go io.Copy(ioutil.Discard, c)
+		close(release)
+		var ids []StreamId
+		for i := 0; i < max+queue; i++ {
+			ids = append(ids, <-done)
+		}
+		if g := int(atomic.LoadInt32(&maxRunning)); g != max {
+			t.Errorf("max %d: %d handlers ran at once", max, g)
+		}
+		if max == 1 {
+			want := []StreamId{1, 3, 5, 7}
+			if !reflect.DeepEqual(ids, want) {
+				t.Errorf("handled %v want %v", ids, want)
+			}
+		}
+		c.Close()
+		sess.Wait()
+		s.Close()
+	}
+}
+
+func TestSessionStreams(t *testing.T) {
+	c, s := pipeConn()
+	release := make(chan bool)
+	sess := Start(NewFramer(s, s), true, func(st *Stream) {
+		<-release
+		st.Reset(Cancel)
+	})
+	cfr := NewFramer(c, c)
+	frames := []Frame{
+		&SynStreamFrame{StreamId: 1, Priority: 3, Headers: http.Header{"X": {"y"}}},
 		&SynStreamFrame{
-			StreamId: 1,
-			CFHeader: ControlFrameHeader{Flags: flags},
+			StreamId: 3,
+			CFHeader: ControlFrameHeader{Flags: ControlFlagFin},
 			Headers:  http.Header{"X": {"y"}},
 		},
-		&DataFrame{StreamId: 1, Data: []byte("foo")},
-		&DataFrame{StreamId: 1, Data: []byte{}, Flags: DataFlagFin},
+		&DataFrame{StreamId: 1, Data: []byte("hello")},
+		&PingFrame{Id: 1},
 	}
-	cpipe, spipe := pipeConn()
-	defer cpipe.Close()
-	defer spipe.Close()
-	sfr := NewFramer(spipe, spipe)
+	for _, f := range frames {
+		if err := cfr.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Once the ping comes back, the frames before it are handled.
+	if _, err := cfr.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	got := sess.Streams()
+	want := []StreamInfo{
+		{Id: 1, Priority: 3, BytesRecv: 5},
+		{Id: 3, RecvClosed: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Streams = %+v want %+v", got, want)
+	}
+	for i := range got {
+		if got[i].Age <= 0 {
+			t.Errorf("#%d: Age = %v want > 0", i, got[i].Age)
+		}
+		got[i].Age = 0
+		if got[i] != want[i] {
+			t.Errorf("#%d: %+v want %+v", i, got[i], want[i])
+		}
+	}
+	go io.Copy(ioutil.Discard, c)
+	close(release)
+	c.Close()
+	sess.Wait()
+	s.Close()
+}
+
+func TestSessionPing(t *testing.T) {
+	c, s := pipeConn()
+	sfr := NewFramer(s, s)
 	go func() {
-		var fs []Frame
+		// Echo one ping, then stop answering.
 		f, err := sfr.ReadFrame()
 		if err != nil {
-			t.Fatal(err)
+			return
 		}
-		fs = append(fs, f)
+		sfr.WriteFrame(f)
+		io.Copy(ioutil.Discard, s)
+	}()
+	sess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	if _, err := sess.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := sess.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v want %v", err, context.DeadlineExceeded)
+	}
+	s.Close()
+	sess.Wait()
+	c.Close()
+}
+
+func TestSessionReadFrame(t *testing.T) {
+	c, s := pipeConn()
+	type frame struct {
+		p   string
+		fin bool
+		err error
+	}
+	got := make(chan []frame, 1)
+	sess := Start(NewFramer(s, s), true, func(st *Stream) {
+		var fs []frame
 		for {
-			f, err := sfr.ReadFrame()
+			p, fin, err := st.ReadFrame()
+			fs = append(fs, frame{string(p), fin, err})
+			if fin || err != nil {
+				break
+			}
+		}
+		got <- fs
+		st.Reset(Cancel)
+	})
+	go io.Copy(ioutil.Discard, c)
+	cfr := NewFramer(c, c)
+	frames := []Frame{
+		&SynStreamFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}},
+		&DataFrame{StreamId: 1, Data: []byte("foo")},
+		&DataFrame{StreamId: 1, Data: []byte{}},
+		&DataFrame{StreamId: 1, Data: []byte("hello")},
+		&DataFrame{StreamId: 1, Data: []byte("x")},
+		&DataFrame{StreamId: 1, Flags: DataFlagFin},
+	}
+	for _, f := range frames {
+		if err := cfr.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := <-got
+	// The handler may see the FIN with the last frame
+	// or on its own, depending on timing.
+	if n := len(fs); n > 0 && fs[n-1] == (frame{"", true, io.EOF}) {
+		fs = fs[:n-1]
+		fs[len(fs)-1].fin = true
+	}
+	want := []frame{{"foo", false, nil}, {"hello", false, nil}, {"x", true, nil}}
+	if !reflect.DeepEqual(fs, want) {
+		t.Errorf("frames = %+v want %+v", fs, want)
+	}
+	c.Close()
+	sess.Wait()
+	s.Close()
+}
+
+func TestSessionClosed(t *testing.T) {
+	c, s := pipeConn()
+	sess := Start(NewFramer(s, s), true, func(st *Stream) { failHandler(t, st) })
+	if sess.Closed() {
+		t.Fatal("Closed = true before the session stopped")
+	}
+	c.Close()
+	sess.Wait()
+	if !sess.Closed() {
+		t.Fatal("Closed = false after Wait returned")
+	}
+	s.Close()
+}
+
+func TestSessionClientFastReply(t *testing.T) {
+	// The peer sends SYN_REPLY the instant it sees SYN_STREAM.
+	// The reply must never be mistaken for one on an unknown
+	// stream; the only RST_STREAM the peer sees is our Cancel.
+	for i := 0; i < 100; i++ {
+		cpipe, spipe := pipeConn()
+		sfr := NewFramer(spipe, spipe)
+		got := make(chan Frame, 1)
+		go func() {
+			defer close(got)
+			if _, err := sfr.ReadFrame(); err != nil {
+				return
+			}
+			err := sfr.WriteFrame(&SynReplyFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}})
 			if err != nil {
-				t.Fatal(err)
+				return
 			}
-			fs = append(fs, f)
-			if f, ok := f.(*DataFrame); ok && f.Flags&DataFlagFin != 0 {
-				got <- fs
-				break
+			f, err := sfr.ReadFrame()
+			if err != nil {
+				return
 			}
+			got <- f
+			io.Copy(ioutil.Discard, spipe)
+		}()
+		cfr := NewFramer(cpipe, cpipe)
+		sess := Start(cfr, false, func(st *Stream) { failHandler(t, st) })
+		st, err := sess.Open(http.Header{"X": {"y"}}, ControlFlagFin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := st.Header(); h == nil {
+			t.Fatalf("#%d: Header = nil", i)
+		}
+		st.Reset(Cancel)
+		f := <-got
+		if f == nil {
+			t.Fatalf("#%d: no frame after SYN_REPLY", i)
+		}
+		pubdiff(t, fmt.Sprintf("#%d", i), f, &RstStreamFrame{StreamId: 1, Status: Cancel})
+		cpipe.Close()
+		spipe.Close()
+	}
+}
+
+func TestSessionClientDataBeforeReply(t *testing.T) {
+	cpipe, spipe := pipeConn()
+	defer cpipe.Close()
+	defer spipe.Close()
+	sfr := NewFramer(spipe, spipe)
+	got := make(chan Frame, 1)
+	go func() {
+		defer close(got)
+		if _, err := sfr.ReadFrame(); err != nil {
+			return
+		}
+		err := sfr.WriteFrame(&DataFrame{StreamId: 1, Data: []byte("foo")})
+		if err != nil {
+			return
 		}
+		err = sfr.WriteFrame(&SynReplyFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}})
+		if err != nil {
+			return
+		}
+		f, err := sfr.ReadFrame()
+		if err != nil {
+			return
+		}
+		got <- f
 		io.Copy(ioutil.Discard, spipe)
 	}()
 	cfr := NewFramer(cpipe, cpipe)
 	sess := Start(cfr, false, func(st *Stream) { failHandler(t, st) })
-	st, err := sess.Open(http.Header{"X": {"y"}}, flags)
+	st, err := sess.Open(http.Header{"X": {"y"}}, ControlFlagFin)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if gh := st.Header(); gh != nil {
-		t.Fatalf("Header = %+v want nil", gh)
+	pubdiff(t, "", <-got, &RstStreamFrame{StreamId: 1, Status: ProtocolError})
+	if h := st.Header(); h != nil {
+		t.Errorf("Header = %v want nil", h)
 	}
-	const p = "foo"
-	_, err = io.WriteString(st, p)
+	if _, err := st.Read(make([]byte, 1)); err != resetError(ProtocolError) {
+		t.Errorf("Read err = %v want %v", err, resetError(ProtocolError))
+	}
+}
+
+func TestSessionWasReset(t *testing.T) {
+	var s Session
+	if s.wasReset(0) {
+		t.Error("wasReset(0) = true before any reset")
+	}
+	s.noteReset(0)
+	if !s.wasReset(0) {
+		t.Error("wasReset(0) = false after noteReset(0)")
+	}
+	// Older ids fall out as the ring fills.
+	for id := StreamId(1); id <= StreamId(len(s.resetIds)); id++ {
+		s.noteReset(id)
+	}
+	if s.wasReset(0) {
+		t.Error("wasReset(0) = true after it was overwritten")
+	}
+	if !s.wasReset(1) || !s.wasReset(StreamId(len(s.resetIds))) {
+		t.Error("wasReset = false for a recent id")
+	}
+}
+
+// RST_STREAM from the peer closes the stream in both
+// directions and removes it from the session.
+func TestSessionPeerReset(t *testing.T) {
+	cpipe, spipe := pipeConn()
+	defer cpipe.Close()
+	defer spipe.Close()
+	sfr := NewFramer(spipe, spipe)
+	started := make(chan *Stream, 1)
+	sess := Start(NewFramer(cpipe, cpipe), true, func(st *Stream) {
+		started <- st
+		<-st.Done()
+	})
+	err := sfr.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = st.Close()
+	st := <-started
+	if err = sfr.WriteFrame(&RstStreamFrame{StreamId: 1, Status: Cancel}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-st.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not done after RST_STREAM")
+	}
+	if _, err := st.Read(make([]byte, 1)); err != resetError(Cancel) {
+		t.Errorf("read err = %v want %v", err, resetError(Cancel))
+	}
+	if err := st.Reply(http.Header{"A": {"b"}}, 0); err == nil {
+		t.Error("Reply succeeded on a reset stream")
+	}
+	if n := len(sess.Streams()); n != 0 {
+		t.Errorf("len(Streams) = %d want 0", n)
+	}
+}
+
+// A second SYN_STREAM for an open stream is a protocol
+// error, and closes the stream.
+func TestSessionSynStreamReuse(t *testing.T) {
+	cpipe, spipe := pipeConn()
+	defer cpipe.Close()
+	defer spipe.Close()
+	sfr := NewFramer(spipe, spipe)
+	started := make(chan *Stream, 2)
+	sess := Start(NewFramer(cpipe, cpipe), true, func(st *Stream) {
+		started <- st
+		<-st.Done()
+	})
+	for i := 0; i < 2; i++ {
+		err := sfr.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := sfr.ReadFrame()
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = ioutil.ReadAll(st)
-	if err == nil {
-		t.Fatal("err = nil want not readable")
+	want := &RstStreamFrame{StreamId: 1, Status: ProtocolError}
+	if rf, ok := f.(*RstStreamFrame); !ok || rf.StreamId != want.StreamId || rf.Status != want.Status {
+		t.Fatalf("got %s want %s", DumpFrame(f), DumpFrame(want))
 	}
-	gfs := <-got
-	if len(gfs) != len(want) {
-		t.Fatalf("frames = %+v want %+v", gfs, want)
+	st := <-started
+	select {
+	case <-st.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not done after reused id")
 	}
-	for i := range gfs {
-		pubdiff(t, "", gfs[i], want[i])
+	if _, err := st.Read(make([]byte, 1)); err != resetError(ProtocolError) {
+		t.Errorf("read err = %v want %v", err, resetError(ProtocolError))
+	}
+	if n := len(sess.Streams()); n != 0 {
+		t.Errorf("len(Streams) = %d want 0", n)
+	}
+	select {
+	case <-started:
+		t.Error("handler started for reused id")
+	default:
 	}
 }
 
-func pubdiff(t *testing.T, prefix string, have, want interface{}) {
-	hv := reflect.Indirect(reflect.ValueOf(have))
-	wv := reflect.Indirect(reflect.ValueOf(want))
-	if hv.Type() != wv.Type() {
-		t.Errorf("%s: type = %v want %v", prefix, hv.Type(), wv.Type())
+// DATA after FLAG_FIN gets one RST_STREAM, however many
+// stray frames there are, and the handler can't write after it.
+func TestSessionDataAfterFin(t *testing.T) {
+	cpipe, spipe := pipeConn()
+	defer cpipe.Close()
+	defer spipe.Close()
+	sfr := NewFramer(spipe, spipe)
+	werr := make(chan error, 1)
+	Start(NewFramer(cpipe, cpipe), true, func(st *Stream) {
+		<-st.Done()
+		_, err := st.Write([]byte("late"))
+		werr <- err
+	})
+	go func() {
+		frames := []Frame{
+			&SynStreamFrame{StreamId: 1, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}, Headers: http.Header{"X": {"y"}}},
+			&DataFrame{StreamId: 1},
+			&DataFrame{StreamId: 1},
+			&DataFrame{StreamId: 1, Flags: DataFlagFin},
+			&PingFrame{Id: 1},
+		}
+		for _, f := range frames {
+			if err := sfr.WriteFrame(f); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	var resets int
+	for {
+		f, err := sfr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := f.(*PingFrame); ok {
+			break
+		}
+		rf, ok := f.(*RstStreamFrame)
+		if !ok || rf.StreamId != 1 || rf.Status != StreamAlreadyClosed {
+			t.Fatalf("unexpected frame %s", DumpFrame(f))
+		}
+		resets++
+	}
+	if resets != 1 {
+		t.Errorf("got %d RST_STREAM frames want 1", resets)
+	}
+	if err := <-werr; err == nil {
+		t.Error("handler wrote after RST_STREAM")
+	}
+}
+
+func TestSessionTeardown(t *testing.T) {
+	tests := []struct {
+		trailing string // bytes the peer sends before closing
+		wSessErr error
+		wReadErr error
+	}{
+		{"", nil, io.ErrUnexpectedEOF},
+		{"\x80\x03", io.ErrUnexpectedEOF, errClosed},
+	}
+	for i, tt := range tests {
+		cpipe, spipe := pipeConn()
+		sfr := NewFramer(spipe, spipe)
+		go func() {
+			if _, err := sfr.ReadFrame(); err != nil {
+				return
+			}
+			sfr.WriteFrame(&SynReplyFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}})
+			io.WriteString(spipe, tt.trailing)
+			spipe.Close()
+		}()
+		sess := Start(NewFramer(cpipe, cpipe), false, func(st *Stream) { failHandler(t, st) })
+		st, err := sess.Open(http.Header{"X": {"y"}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Header()
+		if _, err := st.Read(make([]byte, 1)); err != tt.wReadErr {
+			t.Errorf("#%d: read err = %v want %v", i, err, tt.wReadErr)
+		}
+		if err := sess.Wait(); err != tt.wSessErr {
+			t.Errorf("#%d: Wait = %v want %v", i, err, tt.wSessErr)
+		}
+		cpipe.Close()
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	sess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	const d = 50 * time.Millisecond
+	if err := sess.SetIdleTimeout(d); err != nil {
+		t.Fatal(err)
+	}
+	sfr := NewFramer(s, s)
+	go io.Copy(ioutil.Discard, s)
+
+	// Frames from the peer keep the session open.
+	for i := 0; i < 5; i++ {
+		time.Sleep(d / 2)
+		if err := sfr.WriteFrame(&PingFrame{Id: uint32(2*i + 2)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sess.Closed() {
+		t.Fatal("session closed while peer was sending")
+	}
+
+	// Then silence ends it.
+	err := sess.Wait()
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Errorf("Wait = %v want timeout", err)
+	}
+}
+
+func TestSessionKeepAlive(t *testing.T) {
+	const d = 40 * time.Millisecond
+	c, s := net.Pipe()
+	defer s.Close()
+	sess := NewSession(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	sess.KeepAlive = d
+	go sess.Run()
+	sfr := NewFramer(s, s)
+
+	// While the peer is busy, no keepalive PING is sent.
+	go func() {
+		for i := 0; i < 6; i++ {
+			time.Sleep(d / 2)
+			sfr.WriteFrame(&PingFrame{Id: uint32(2*i + 2)})
+		}
+	}()
+	for i := 0; i < 6; i++ {
+		f, err := sfr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f, ok := f.(*PingFrame); !ok || f.Id%2 != 0 {
+			t.Fatalf("frame %d = %s want echo of our PING", i, DumpFrame(f))
+		}
+	}
+
+	// Once the peer goes quiet, the session pings it,
+	// and it closes when the peer doesn't answer.
+	f, err := sfr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := f.(*PingFrame); !ok || f.Id%2 != 1 {
+		t.Fatalf("got %s want keepalive PING", DumpFrame(f))
+	}
+	go io.Copy(ioutil.Discard, s)
+	if err := sess.Wait(); err != ErrKeepAliveTimeout {
+		t.Errorf("Wait = %v want %v", err, ErrKeepAliveTimeout)
+	}
+}
+
+func TestSessionSettingsBadFlags(t *testing.T) {
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	sess := Start(NewFramer(s, s), true, func(st *Stream) { failHandler(t, st) })
+	cfr := NewFramer(c, c)
+	err := cfr.WriteFrame(&SettingsFrame{CFHeader: ControlFrameHeader{Flags: 0x02}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := cfr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubdiff(t, "goaway", f, &GoAwayFrame{Status: GoAwayProtocolError})
+	if err, ok := sess.Wait().(*Error); !ok || err.Err != InvalidControlFrame {
+		t.Errorf("Wait = %v want %v", err, InvalidControlFrame)
+	}
+}
+
+func TestSessionStrictHeaders(t *testing.T) {
+	// The Framer lowercases names, so patch the frame after.
+	var buf bytes.Buffer
+	wfr := NewFramer(&buf, nil)
+	wfr.headerCompressionDisabled = true
+	err := wfr.WriteFrame(&SynStreamFrame{
+		StreamId: 1,
+		CFHeader: ControlFrameHeader{Flags: ControlFlagFin},
+		Headers:  http.Header{"X-Mixed": {"y"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := bytes.Replace(buf.Bytes(), []byte("x-mixed"), []byte("X-Mixed"), 1)
+
+	for _, strict := range []bool{false, true} {
+		c, s := pipeConn()
+		got := make(chan http.Header, 1)
+		sfr := NewFramer(s, s)
+		sfr.headerCompressionDisabled = true
+		sess := NewSession(sfr, true, func(st *Stream) {
+			got <- st.Header()
+			st.Reply(http.Header{"X": {"y"}}, ControlFlagFin)
+		})
+		sess.StrictHeaders = strict
+		go sess.Run()
+		cfr := NewFramer(c, c)
+		cfr.headerCompressionDisabled = true
+		if _, err := c.Write(raw); err != nil {
+			t.Fatal(err)
+		}
+		f, err := cfr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strict {
+			pubdiff(t, "strict", f, &RstStreamFrame{StreamId: 1, Status: ProtocolError})
+			// The session goes on.
+			if err := cfr.WriteFrame(&PingFrame{Id: 1}); err != nil {
+				t.Fatal(err)
+			}
+			f, err := cfr.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pubdiff(t, "ping", f, &PingFrame{Id: 1})
+		} else {
+			pubdiff(t, "lenient", f, &SynReplyFrame{
+				StreamId: 1,
+				CFHeader: ControlFrameHeader{Flags: ControlFlagFin},
+				Headers:  http.Header{"X": {"y"}},
+			})
+			if h := <-got; h.Get("X-Mixed") != "y" {
+				t.Errorf("header = %v want X-Mixed: y", h)
+			}
+		}
+		c.Close()
+		sess.Wait()
+		s.Close()
+	}
+}
+
+// rawSynStream returns a SYN_STREAM frame with FLAG_FIN
+// and an uncompressed header block holding fields in order.
+func rawSynStream(id StreamId, fields []HeaderField) []byte {
+	var block bytes.Buffer
+	binary.Write(&block, binary.BigEndian, uint32(len(fields)))
+	for _, f := range fields {
+		for _, s := range []string{f.Name, f.Value} {
+			binary.Write(&block, binary.BigEndian, uint32(len(s)))
+			block.WriteString(s)
+		}
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint16(0x8000|Version))
+	binary.Write(&b, binary.BigEndian, uint16(TypeSynStream))
+	binary.Write(&b, binary.BigEndian, uint32(ControlFlagFin)<<24|uint32(10+block.Len()))
+	binary.Write(&b, binary.BigEndian, uint32(id))
+	binary.Write(&b, binary.BigEndian, uint32(0)) // associated stream id
+	binary.Write(&b, binary.BigEndian, uint16(0)) // priority and slot
+	b.Write(block.Bytes())
+	return b.Bytes()
+}
+
+func TestSessionRawHeaders(t *testing.T) {
+	fields := []HeaderField{
+		{"x-zeta", "1"},
+		{"X-Alpha", "2"},
+		{"x-multi", "a\x00b"},
+		{":method", "GET"},
+	}
+	for _, keep := range []bool{false, true} {
+		c, s := pipeConn()
+		got := make(chan []HeaderField, 1)
+		sfr := NewFramer(s, s)
+		sfr.headerCompressionDisabled = true
+		sess := NewSession(sfr, true, func(st *Stream) {
+			got <- st.RawHeader()
+			st.Reply(http.Header{"X": {"y"}}, ControlFlagFin)
+		})
+		sess.RawHeaders = keep
+		go sess.Run()
+		cfr := NewFramer(c, c)
+		cfr.headerCompressionDisabled = true
+		if _, err := c.Write(rawSynStream(1, fields)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cfr.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+		var want []HeaderField
+		if keep {
+			want = fields
+		}
+		if raw := <-got; !reflect.DeepEqual(raw, want) {
+			t.Errorf("RawHeaders=%v: RawHeader = %q want %q", keep, raw, want)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestSessionZeroWrite(t *testing.T) {
+	cpipe, spipe := pipeConn()
+	defer cpipe.Close()
+	defer spipe.Close()
+	sfr := NewFramer(spipe, spipe)
+	sess := Start(NewFramer(cpipe, cpipe), false, func(st *Stream) { failHandler(t, st) })
+	opened := make(chan *Stream, 1)
+	go func() {
+		st, err := sess.Open(http.Header{"X": {"y"}}, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- st
+	}()
+	if _, err := sfr.ReadFrame(); err != nil { // SYN_STREAM
+		t.Fatal(err)
+	}
+	st := <-opened
+	for _, p := range [][]byte{nil, {}} {
+		if n, err := st.Write(p); n != 0 || err != nil {
+			t.Errorf("Write(%#v) = %d, %v want 0, nil", p, n, err)
+		}
+	}
+	wrote := make(chan bool)
+	go func() {
+		st.Write([]byte("x"))
+		close(wrote)
+	}()
+	f, err := sfr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No empty DATA frame came first.
+	pubdiff(t, "data", f, &DataFrame{StreamId: 1, Data: []byte("x")})
+	<-wrote
+	if g := sess.Streams()[0].BytesSent; g != 1 {
+		t.Errorf("BytesSent = %d want 1", g)
+	}
+}
+
+// Run with -race.
+func TestSessionStreamReadClose(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		cpipe, spipe := pipeConn()
+		sfr := NewFramer(spipe, spipe)
+		go func() {
+			if _, err := sfr.ReadFrame(); err != nil {
+				return
+			}
+			sfr.WriteFrame(&SynReplyFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}})
+			for j := 0; j < 10; j++ {
+				sfr.WriteFrame(&DataFrame{StreamId: 1, Data: []byte("foo")})
+			}
+			sfr.WriteFrame(&DataFrame{StreamId: 1, Flags: DataFlagFin})
+			io.Copy(ioutil.Discard, spipe)
+		}()
+		sess := Start(NewFramer(cpipe, cpipe), false, func(st *Stream) { failHandler(t, st) })
+		st, err := sess.Open(http.Header{"X": {"y"}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Header()
+		done := make(chan bool)
+		go func() {
+			io.Copy(ioutil.Discard, st)
+			close(done)
+		}()
+		st.Close()
+		st.Reset(Cancel)
+		<-done
+		cpipe.Close()
+		spipe.Close()
+		sess.Wait()
+	}
+}
+
+// Run with -race.
+func TestSessionStreamWritePeerFin(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		c, s := pipeConn()
+		hErr := make(chan error, 1)
+		sess := Start(NewFramer(s, s), true, func(st *Stream) {
+			if err := st.Reply(http.Header{"X": {"y"}}, 0); err != nil {
+				hErr <- err
+				return
+			}
+			for j := 0; j < 20; j++ {
+				if _, err := io.WriteString(st, "x"); err != nil {
+					hErr <- err
+					return
+				}
+			}
+			hErr <- st.Close()
+		})
+		cfr := NewFramer(c, c)
+		err := cfr.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The peer finishes its side while we are still writing.
+		err = cfr.WriteFrame(&DataFrame{StreamId: 1, Flags: DataFlagFin})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			f, err := cfr.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f, ok := f.(*DataFrame); ok && f.Flags&DataFlagFin != 0 {
+				break
+			}
+		}
+		if err := <-hErr; err != nil {
+			t.Errorf("#%d: handler err = %v", i, err)
+		}
+		c.Close()
+		sess.Wait()
+		s.Close()
+	}
+}
+
+func TestSessionSettingsWindow(t *testing.T) {
+	cpipe, spipe := pipeConn()
+	defer cpipe.Close()
+	defer spipe.Close()
+	sfr := NewFramer(spipe, spipe)
+	sess := Start(NewFramer(cpipe, cpipe), false, func(st *Stream) { failHandler(t, st) })
+	opened := make(chan *Stream, 1)
+	go func() {
+		st, err := sess.Open(http.Header{"X": {"y"}}, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- st
+	}()
+	if _, err := sfr.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	st := <-opened
+	settings := func(n uint32) {
+		err := sfr.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+			{Id: SettingsInitialWindowSize, Value: n},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Once the ping comes back, the settings are applied.
+		if err := sfr.WriteFrame(&PingFrame{Id: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func() Frame {
+		f, err := sfr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	readData := func(want int) {
+		f := next()
+		if _, ok := f.(*PingFrame); ok {
+			f = next()
+		}
+		if d, ok := f.(*DataFrame); !ok || len(d.Data) != want {
+			t.Fatalf("frame = %+v want %d bytes of DATA", f, want)
+		}
+	}
+
+	// Shrink the window of the open stream to 10 bytes.
+	settings(10)
+	pubdiff(t, "ping", next(), &PingFrame{Id: 2})
+	go func() {
+		if _, err := st.Write(make([]byte, 30)); err != nil {
+			t.Error(err)
+		}
+	}()
+	readData(10)
+
+	// Grow it by 10 bytes, then send an update for 10 more.
+	settings(20)
+	readData(10)
+	err := sfr.WriteFrame(&WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readData(10)
+}
+
+func TestSessionNegativeWindow(t *testing.T) {
+	cpipe, spipe := pipeConn()
+	defer cpipe.Close()
+	defer spipe.Close()
+	sfr := NewFramer(spipe, spipe)
+	sess := Start(NewFramer(cpipe, cpipe), false, func(st *Stream) { failHandler(t, st) })
+	opened := make(chan *Stream, 1)
+	go func() {
+		st, err := sess.Open(http.Header{"X": {"y"}}, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- st
+	}()
+	next := func() Frame {
+		f, err := sfr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	write := func(f Frame) {
+		if err := sfr.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next() // SYN_STREAM
+	st := <-opened
+	go func() {
+		if _, err := st.Write(make([]byte, 20)); err != nil {
+			t.Error(err)
+		}
+	}()
+	pubdiff(t, "data 1", next(), &DataFrame{StreamId: 1, Data: make([]byte, 20)})
+
+	// 20 bytes are in flight, so a window of 10 leaves -10.
+	write(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{Id: SettingsInitialWindowSize, Value: 10},
+	}})
+	write(&WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 5})
+	write(&PingFrame{Id: 2})
+	pubdiff(t, "ping 1", next(), &PingFrame{Id: 2})
+
+	go func() {
+		// This blocks until the window recovers.
+		if _, err := st.Write(make([]byte, 5)); err != nil {
+			t.Error(err)
+		}
+	}()
+	write(&PingFrame{Id: 4})
+	// The window is still negative; no DATA may come first.
+	pubdiff(t, "ping 2", next(), &PingFrame{Id: 4})
+
+	write(&WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 10})
+	pubdiff(t, "data 2", next(), &DataFrame{StreamId: 1, Data: make([]byte, 5)})
+}
+
+func TestSessionWindowTimeout(t *testing.T) {
+	cpipe, spipe := pipeConn()
+	defer cpipe.Close()
+	defer spipe.Close()
+	sfr := NewFramer(spipe, spipe)
+	sess := NewSession(NewFramer(cpipe, cpipe), false, func(st *Stream) { failHandler(t, st) })
+	sess.WindowTimeout = 10 * time.Millisecond
+	go sess.Run()
+	next := func() Frame {
+		f, err := sfr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	opened := make(chan *Stream, 1)
+	go func() {
+		st, err := sess.Open(http.Header{"X": {"y"}}, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- st
+	}()
+	next() // SYN_STREAM
+	st := <-opened
+	// The peer never sends WINDOW_UPDATE.
+	err := sfr.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{Id: SettingsInitialWindowSize, Value: 5},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sfr.WriteFrame(&PingFrame{Id: 2}); err != nil {
+		t.Fatal(err)
+	}
+	pubdiff(t, "ping", next(), &PingFrame{Id: 2})
+
+	werr := make(chan error, 1)
+	go func() {
+		_, err := st.Write(make([]byte, 10))
+		werr <- err
+	}()
+	pubdiff(t, "data", next(), &DataFrame{StreamId: 1, Data: make([]byte, 5)})
+	pubdiff(t, "reset", next(), &RstStreamFrame{StreamId: 1, Status: Cancel})
+	if err := <-werr; err != errWindowTimeout {
+		t.Errorf("write err = %v want %v", err, errWindowTimeout)
+	}
+}
+
+func TestSessionSettings(t *testing.T) {
+	c, s := pipeConn()
+	changed := make(chan map[SettingsId]uint32, 1)
+	sess := NewSession(NewFramer(s, s), true, func(st *Stream) { failHandler(t, st) })
+	sess.SettingsChanged = func(m map[SettingsId]uint32) { changed <- m }
+	go sess.Run()
+	cfr := NewFramer(c, c)
+	err := cfr.WriteFrame(&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{Id: SettingsMaxConcurrentStreams, Value: 100},
+		{Id: SettingsInitialWindowSize, Value: 1000},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[SettingsId]uint32{
+		SettingsMaxConcurrentStreams: 100,
+		SettingsInitialWindowSize:    1000,
+	}
+	if g := <-changed; !reflect.DeepEqual(g, want) {
+		t.Errorf("SettingsChanged got %v want %v", g, want)
+	}
+	if g := sess.Settings(); !reflect.DeepEqual(g, want) {
+		t.Errorf("Settings = %v want %v", g, want)
+	}
+	sess.Settings()[SettingsRoundTripTime] = 1
+	if g := sess.Settings(); !reflect.DeepEqual(g, want) {
+		t.Errorf("after modifying the copy, Settings = %v want %v", g, want)
+	}
+	c.Close()
+	sess.Wait()
+	s.Close()
+}
+
+func TestSessionSettingsAllIds(t *testing.T) {
+	c, s := pipeConn()
+	changed := make(chan map[SettingsId]uint32, 1)
+	sess := NewSession(NewFramer(s, s), true, func(st *Stream) { failHandler(t, st) })
+	sess.SettingsChanged = func(m map[SettingsId]uint32) { changed <- m }
+	go sess.Run()
+	var v []SettingsFlagIdValue
+	want := make(map[SettingsId]uint32)
+	for id := SettingsUploadBandwidth; id <= SettingsClientCretificateVectorSize; id++ {
+		v = append(v, SettingsFlagIdValue{Id: id, Value: 100 + uint32(id)})
+		want[id] = 100 + uint32(id)
+	}
+	if err := NewFramer(c, c).WriteFrame(&SettingsFrame{FlagIdValues: v}); err != nil {
+		t.Fatal(err)
+	}
+	<-changed
+	if g := sess.Settings(); !reflect.DeepEqual(g, want) {
+		t.Errorf("Settings = %v want %v", g, want)
+	}
+	for id, w := range want {
+		if g, ok := sess.Setting(id); !ok || g != w {
+			t.Errorf("Setting(%d) = %d, %v want %d, true", id, g, ok, w)
+		}
+	}
+	if g, ok := sess.Setting(0); ok {
+		t.Errorf("Setting(0) = %d, true want false", g)
+	}
+	c.Close()
+	sess.Wait()
+	s.Close()
+}
+
+func TestSessionSendRoundTripTime(t *testing.T) {
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	sfr := NewFramer(s, s)
+	sess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sess.SendRoundTripTime(context.Background())
+		errc <- err
+	}()
+	next := func() Frame {
+		f, err := sfr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	ping := next()
+	time.Sleep(20 * time.Millisecond)
+	if err := sfr.WriteFrame(ping); err != nil {
+		t.Fatal(err)
+	}
+	f := next()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	sf, ok := f.(*SettingsFrame)
+	if !ok || len(sf.FlagIdValues) != 1 || sf.FlagIdValues[0].Id != SettingsRoundTripTime {
+		t.Fatalf("got %s want SETTINGS with ROUND_TRIP_TIME", DumpFrame(f))
+	}
+	if ms := sf.FlagIdValues[0].Value; ms < 20 {
+		t.Errorf("round-trip time = %dms want at least 20ms", ms)
+	}
+}
+
+func TestSessionSetSettings(t *testing.T) {
+	const n = 3 * defaultInitWnd
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	got := make(chan error, 1)
+	sess := Start(NewFramer(s, s), true, func(st *Stream) {
+		b, err := ioutil.ReadAll(st)
+		if err == nil && len(b) != n {
+			err = fmt.Errorf("read %d bytes want %d", len(b), n)
+		}
+		got <- err
+	})
+	cfr := NewFramer(c, c)
+	err := cfr.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sess.SetSettings(SettingsFlagIdValue{Id: SettingsInitialWindowSize, Value: n})
+	if _, err := cfr.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(ioutil.Discard, c)
+	// The open stream can now take n bytes at once.
+	err = cfr.WriteFrame(&DataFrame{StreamId: 1, Data: make([]byte, n), Flags: DataFlagFin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionClientReply(t *testing.T) {
+	reply := &SynReplyFrame{StreamId: 1, Headers: http.Header{"X": {"y"}}}
+	tests := []struct {
+		frames []Frame // sent by the server after SYN_STREAM
+		want   Frame   // next frame the server reads
+	}{
+		// A single reply, consumed after more frames
+		// arrive, draws no reset; a duplicate does.
+		{[]Frame{reply, &PingFrame{Id: 2}}, &PingFrame{Id: 2}},
+		{[]Frame{reply, reply}, &RstStreamFrame{StreamId: 1, Status: StreamInUse}},
+	}
+	for i, tt := range tests {
+		cpipe, spipe := pipeConn()
+		sfr := NewFramer(spipe, spipe)
+		got := make(chan Frame, 1)
+		go func() {
+			defer close(got)
+			if _, err := sfr.ReadFrame(); err != nil {
+				return
+			}
+			for _, f := range tt.frames {
+				if err := sfr.WriteFrame(f); err != nil {
+					return
+				}
+			}
+			f, err := sfr.ReadFrame()
+			if err != nil {
+				return
+			}
+			got <- f
+			io.Copy(ioutil.Discard, spipe)
+		}()
+		sess := Start(NewFramer(cpipe, cpipe), false, func(st *Stream) { failHandler(t, st) })
+		st, err := sess.Open(http.Header{"X": {"y"}}, ControlFlagFin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubdiff(t, fmt.Sprintf("#%d", i), <-got, tt.want)
+		if h := st.Header(); !reflect.DeepEqual(h, reply.Headers) {
+			t.Errorf("#%d: Header = %v want %v", i, h, reply.Headers)
+		}
+		cpipe.Close()
+		spipe.Close()
+	}
+}
+
+func TestSessionUnidirectional(t *testing.T) {
+	var flags ControlFlags = ControlFlagUnidirectional
+	got := make(chan []Frame, 1)
+	want := []Frame{
+		&SynStreamFrame{
+			StreamId: 1,
+			CFHeader: ControlFrameHeader{Flags: flags},
+			Headers:  http.Header{"X": {"y"}},
+		},
+		&DataFrame{StreamId: 1, Data: []byte("foo")},
+		&DataFrame{StreamId: 1, Data: []byte{}, Flags: DataFlagFin},
+	}
+	cpipe, spipe := pipeConn()
+	defer cpipe.Close()
+	defer spipe.Close()
+	sfr := NewFramer(spipe, spipe)
+	go func() {
+		var fs []Frame
+		f, err := sfr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs = append(fs, f)
+		for {
+			f, err := sfr.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs = append(fs, f)
+			if f, ok := f.(*DataFrame); ok && f.Flags&DataFlagFin != 0 {
+				got <- fs
+				break
+			}
+		}
+		io.Copy(ioutil.Discard, spipe)
+	}()
+	cfr := NewFramer(cpipe, cpipe)
+	sess := Start(cfr, false, func(st *Stream) { failHandler(t, st) })
+	st, err := sess.Open(http.Header{"X": {"y"}}, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gh := st.Header(); gh != nil {
+		t.Fatalf("Header = %+v want nil", gh)
+	}
+	const p = "foo"
+	_, err = io.WriteString(st, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(st)
+	if err == nil {
+		t.Fatal("err = nil want not readable")
+	}
+	gfs := <-got
+	if len(gfs) != len(want) {
+		t.Fatalf("frames = %+v want %+v", gfs, want)
+	}
+	for i := range gfs {
+		pubdiff(t, "", gfs[i], want[i])
+	}
+}
+
+// SPDY/3 has no session-level window, so WINDOW_UPDATE
+// for stream 0 is ignored, even before any stream exists.
+func TestSessionWindowUpdateStreamZero(t *testing.T) {
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	Start(NewFramer(s, s), true, func(st *Stream) { failHandler(t, st) })
+	cfr := NewFramer(c, c)
+	if err := cfr.WriteFrame(&WindowUpdateFrame{StreamId: 0, DeltaWindowSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	// The next frame is the echo, not RST_STREAM or GOAWAY.
+	if err := cfr.WriteFrame(&PingFrame{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cfr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(*PingFrame); !ok {
+		t.Errorf("got %s want PING", DumpFrame(f))
+	}
+}
+
+// Run with -race. Frames from WriteControlFrame interleave
+// whole with the session's own, header compression included.
+func TestSessionWriteControlFrame(t *testing.T) {
+	const n = 50
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	sess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		sfr := NewFramer(s, s)
+		var ndata, nheaders int
+		for ndata < n || nheaders < n {
+			f, err := sfr.ReadFrame()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			switch f := f.(type) {
+			case *DataFrame:
+				ndata++
+			case *HeadersFrame:
+				if f.Headers.Get("X-Seq") == "" {
+					t.Errorf("HEADERS missing X-Seq: %v", f.Headers)
+				}
+				nheaders++
+			}
+		}
+	}()
+	st, err := sess.Open(http.Header{":path": {"/"}}, ControlFlagUnidirectional)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < n; i++ {
+			st.Write(make([]byte, 1000))
+		}
+	}()
+	for i := 0; i < n; i++ {
+		f := &HeadersFrame{StreamId: st.Id(), Headers: http.Header{"X-Seq": {fmt.Sprint(i)}}}
+		if err := sess.WriteControlFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer did not get all frames")
+	}
+}
+
+func TestSessionOpenClosing(t *testing.T) {
+	c, s := pipeConn()
+	sess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	s.Close()
+	sess.Wait()
+	_, err := sess.Open(http.Header{":path": {"/"}}, ControlFlagFin)
+	if !errors.Is(err, ErrSessionClosing) {
+		t.Errorf("Open err = %v want %v", err, ErrSessionClosing)
+	}
+	c.Close()
+}
+
+// GOAWAY fails the streams we opened that the peer won't
+// process, with an error that says they can be retried.
+// The rest carry on.
+func TestSessionGoAwayRefused(t *testing.T) {
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	sfr := NewFramer(s, s)
+	csess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	read := make(chan error, 1)
+	go func() {
+		for i := 0; i < 2; i++ {
+			if _, err := sfr.ReadFrame(); err != nil {
+				read <- err
+				return
+			}
+		}
+		read <- nil
+	}()
+	var sts []*Stream
+	for i := 0; i < 2; i++ {
+		st, err := csess.Open(http.Header{":path": {"/"}}, ControlFlagFin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sts = append(sts, st)
+	}
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+	frames := []Frame{
+		&GoAwayFrame{LastGoodStreamId: 1},
+		&SynReplyFrame{StreamId: 1, Headers: http.Header{":status": {"200"}}, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}},
+	}
+	for _, f := range frames {
+		if err := sfr.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := sts[0].Header(); h == nil {
+		t.Error("stream 1 got no reply")
+	}
+	select {
+	case <-sts[1].Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream 3 not done after GOAWAY")
+	}
+	if _, err := sts[1].Read(make([]byte, 1)); err != ErrGoingAway {
+		t.Errorf("stream 3 read err = %v want %v", err, ErrGoingAway)
+	}
+	if _, err := csess.Open(http.Header{":path": {"/"}}, ControlFlagFin); err != ErrGoingAway {
+		t.Errorf("Open err = %v want %v", err, ErrGoingAway)
+	}
+}
+
+// A peer that has sent GOAWAY may still open streams.
+func TestSessionGoAwayPeerOpens(t *testing.T) {
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	cfr := NewFramer(c, c)
+	Start(NewFramer(s, s), true, func(st *Stream) {
+		st.Reply(http.Header{":status": {"200"}}, ControlFlagFin)
+	})
+	frames := []Frame{
+		&GoAwayFrame{},
+		&SynStreamFrame{StreamId: 1, Headers: http.Header{":path": {"/"}}, CFHeader: ControlFrameHeader{Flags: ControlFlagFin}},
+	}
+	for _, f := range frames {
+		if err := cfr.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := cfr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := f.(*SynReplyFrame); !ok || f.StreamId != 1 {
+		t.Errorf("got %s want SYN_REPLY for stream 1", DumpFrame(f))
+	}
+}
+
+func TestSessionGoAway(t *testing.T) {
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	ssess := NewSession(NewFramer(s, s), true, func(st *Stream) {
+		st.Reply(http.Header{":status": {"200"}}, ControlFlagFin)
+	})
+	var logged []string
+	ssess.Logf = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	go ssess.Run()
+	csess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	st, err := csess.Open(http.Header{":path": {"/"}}, ControlFlagFin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Header() // wait for the reply
+	if err := ssess.GoAway(GoAwayInternalError, "shutting down"); err != nil {
+		t.Fatal(err)
+	}
+	// GOAWAY has no room for the reason, so it's only logged.
+	if len(logged) != 1 || !strings.Contains(logged[0], "shutting down") {
+		t.Errorf("logged %q want the reason", logged)
+	}
+	if _, err := ssess.Open(http.Header{":path": {"/"}}, ControlFlagFin); err != ErrGoingAway {
+		t.Errorf("server Open err = %v want %v", err, ErrGoingAway)
+	}
+	// The echo comes after GOAWAY, so by then
+	// the client has seen it.
+	if _, err := csess.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := csess.Open(http.Header{":path": {"/"}}, ControlFlagFin); err != ErrGoingAway {
+		t.Errorf("client Open err = %v want %v", err, ErrGoingAway)
+	}
+	s.Close()
+	want := &GoAwayError{LastGoodStreamId: 1, Status: GoAwayInternalError}
+	if err := csess.Wait(); !reflect.DeepEqual(err, want) {
+		t.Errorf("Wait err = %v want %v", err, want)
+	}
+}
+
+// Run with -race. Read, Write, Reply, Close, and Reset
+// all race with each other and with RST_STREAM from the
+// peer, which arrives on the session's read goroutine.
+func TestStreamConcurrentClose(t *testing.T) {
+	const n = 100
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	done := make(chan bool, n)
+	Start(NewFramer(s, s), true, func(st *Stream) {
+		var wg sync.WaitGroup
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			io.Copy(ioutil.Discard, st)
+		}()
+		go func() {
+			defer wg.Done()
+			st.Reply(http.Header{":status": {"200"}}, 0)
+			for {
+				if _, err := st.Write([]byte("hello")); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			st.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			st.Reset(Cancel)
+		}()
+		wg.Wait()
+		done <- true
+	})
+	sess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	for i := 0; i < n; i++ {
+		st, err := sess.Open(http.Header{":path": {"/"}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go st.Write([]byte("hello"))
+		go st.Reset(Cancel)
+		st.Read(make([]byte, 10))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d handlers stuck", n-i, n)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	hErr := make(chan error, 2)
+	ssess := Start(NewFramer(s, s), true, func(st *Stream) { hErr <- echoHandler(t, st) })
+	csess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	var total int64
+	for _, msg := range []string{"hello", "a longer message"} {
+		st, err := csess.Open(http.Header{"X": {"y"}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			io.WriteString(st, msg)
+			st.Close()
+		}()
+		b, err := ioutil.ReadAll(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-hErr; err != nil {
+			t.Fatal(err)
+		}
+		n := int64(len(msg))
+		total += n
+		if g, w := st.Stats(), (Stats{n, n}); g != w || string(b) != msg {
+			t.Errorf("%q: Stats = %+v want %+v", b, g, w)
+		}
+	}
+	want := Stats{total, total}
+	if g := csess.Stats(); g != want {
+		t.Errorf("client Session.Stats = %+v want %+v", g, want)
+	}
+	if g := ssess.Stats(); g != want {
+		t.Errorf("server Session.Stats = %+v want %+v", g, want)
+	}
+}
+
+// Run with -race. Both ends close or reset the same
+// stream at once, while the client asks for the reply's
+// header size as the reply arrives.
+func TestStreamCloseBothSides(t *testing.T) {
+	const n = 50
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	done := make(chan bool, n)
+	Start(NewFramer(s, s), true, func(st *Stream) {
+		st.Reply(http.Header{":status": {"200"}}, 0)
+		if st.Id()%4 == 1 {
+			st.Close()
+		} else {
+			st.Reset(Cancel)
+		}
+		io.Copy(ioutil.Discard, st)
+		done <- true
+	})
+	sess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	for i := 0; i < n; i++ {
+		st, err := sess.Open(http.Header{":path": {"/"}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go st.HeaderSize()
+		go st.Close()
+		if i%2 == 1 {
+			go st.Reset(Cancel)
+		}
+		io.Copy(ioutil.Discard, st)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d handlers stuck", n-i, n)
+		}
+	}
+}
+
+func TestStreamReadFrom(t *testing.T) {
+	// More than the initial window,
+	// so ReadFrom has to wait for it.
+	want := bytes.Repeat([]byte("0123456789"), 20000)
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	errc := make(chan error, 1)
+	Start(NewFramer(s, s), true, func(st *Stream) {
+		st.Reply(http.Header{":status": {"200"}}, 0)
+		// Hide bytes.Reader's WriteTo method,
+		// so that io.Copy uses ReadFrom.
+		n, err := io.Copy(st, struct{ io.Reader }{bytes.NewReader(want)})
+		if err == nil && n != int64(len(want)) {
+			err = fmt.Errorf("copied %d bytes want %d", n, len(want))
+		}
+		st.Close()
+		errc <- err
+	})
+	sess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	st, err := sess.Open(http.Header{":path": {"/"}}, ControlFlagFin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes, not the %d written", len(got), len(want))
+	}
+}
+
+func TestStreamDiscard(t *testing.T) {
+	// More than the initial window, so Discard
+	// has to grant more for the server to finish.
+	const n = 200000
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	errc := make(chan error, 1)
+	Start(NewFramer(s, s), true, func(st *Stream) {
+		st.Reply(http.Header{":status": {"200"}}, 0)
+		_, err := st.Write(make([]byte, n))
+		st.Close()
+		errc <- err
+	})
+	sess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+	st, err := sess.Open(http.Header{":path": {"/"}}, ControlFlagFin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Discard(); err != nil {
+		t.Fatal("Discard err", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if g := st.Stats().BytesRecv; g != n {
+		t.Errorf("BytesRecv = %d want %d", g, n)
+	}
+	if _, err := st.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after Discard err = %v want EOF", err)
+	}
+}
+
+// smallReads sends n bytes to a handler that reads them
+// 100 bytes at a time, and returns the number of
+// WINDOW_UPDATE frames the handler's session sent.
+func smallReads(tb testing.TB, n int) (updates int) {
+	const chunk = 1000
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	Start(NewFramer(s, s), true, func(st *Stream) {
+		b := make([]byte, 100)
+		var err error
+		for err == nil {
+			_, err = st.Read(b)
+		}
+		st.Reply(http.Header{":status": {"200"}}, ControlFlagFin)
+	})
+	cfr := NewFramer(c, c)
+	if err := cfr.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{":path": {"/"}}}); err != nil {
+		tb.Fatal(err)
+	}
+	credit := make(chan int, n/100+1)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			f, err := cfr.ReadFrame()
+			if err != nil {
+				tb.Error(err)
+				return
+			}
+			switch f := f.(type) {
+			case *WindowUpdateFrame:
+				updates++
+				credit <- int(f.DeltaWindowSize)
+			case *SynReplyFrame:
+				return
+			default:
+				tb.Errorf("unexpected frame %s", DumpFrame(f))
+				return
+			}
+		}
+	}()
+	wnd := defaultInitWnd
+	for sent := 0; sent < n; sent += chunk {
+		for wnd < chunk {
+			wnd += <-credit
+		}
+		f := &DataFrame{StreamId: 1, Data: make([]byte, chunk)}
+		if sent+chunk >= n {
+			f.Flags = DataFlagFin
+		}
+		if err := cfr.WriteFrame(f); err != nil {
+			tb.Fatal(err)
+		}
+		wnd -= chunk
+	}
+	<-done
+	return updates
+}
+
+// After CloseRead, a stream goes on granting window for the
+// data it drops, so the peer can finish sending, but it still
+// holds the peer to the window.
+func TestStreamCloseRead(t *testing.T) {
+	c, s := pipeConn()
+	defer c.Close()
+	defer s.Close()
+	closed := make(chan bool)
+	Start(NewFramer(s, s), true, func(st *Stream) {
+		st.CloseRead()
+		closed <- true
+	})
+	cfr := NewFramer(c, c)
+	credit := make(chan int, 100)
+	rst := make(chan *RstStreamFrame, 10)
+	go func() {
+		for {
+			f, err := cfr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *WindowUpdateFrame:
+				credit <- int(f.DeltaWindowSize)
+			case *RstStreamFrame:
+				rst <- f
+			}
+		}
+	}()
+	write := func(f Frame) {
+		if err := cfr.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(&SynStreamFrame{StreamId: 1, Headers: http.Header{":path": {"/"}}})
+	<-closed
+	const (
+		n     = 4 * defaultInitWnd
+		chunk = 1000
+	)
+	wnd := defaultInitWnd
+	for sent := 0; sent < n; sent += chunk {
+		for wnd < chunk {
+			select {
+			case d := <-credit:
+				wnd += d
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no WINDOW_UPDATE after %d bytes", sent)
+			}
+		}
+		write(&DataFrame{StreamId: 1, Data: make([]byte, chunk)})
+		wnd -= chunk
+	}
+
+	write(&SynStreamFrame{StreamId: 3, Headers: http.Header{":path": {"/"}}})
+	<-closed
+	write(&DataFrame{StreamId: 3, Data: make([]byte, defaultInitWnd+1)})
+	select {
+	case f := <-rst:
+		if f.StreamId != 3 || f.Status != FlowControlError {
+			t.Errorf("got %s want RST_STREAM 3 with FLOW_CONTROL_ERROR", DumpFrame(f))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no RST_STREAM for DATA beyond the window")
+	}
+}
+
+func TestStreamWindowUpdateBatching(t *testing.T) {
+	const n = 1000000
+	got := smallReads(t, n)
+	// One update per half window read.
+	if max := n / (defaultInitWnd / 2); got < 1 || got > max {
+		t.Errorf("sent %d WINDOW_UPDATE frames, want 1 to %d", got, max)
+	}
+}
+
+func BenchmarkStreamSmallReads(b *testing.B) {
+	const n = 100000
+	b.SetBytes(n)
+	var updates int
+	for i := 0; i < b.N; i++ {
+		updates += smallReads(b, n)
+	}
+	b.ReportMetric(float64(updates)/float64(b.N), "window-updates/op")
+}
+
+func TestStreamWriteString(t *testing.T) {
+	for _, n := range []int{0, 5, smallWrite + 1, 100000} {
+		want := strings.Repeat("x", n)
+		c, s := pipeConn()
+		Start(NewFramer(s, s), true, func(st *Stream) {
+			st.Reply(http.Header{":status": {"200"}}, 0)
+			if m, err := io.WriteString(st, want); m != n || err != nil {
+				t.Errorf("WriteString = %d, %v want %d, nil", m, err, n)
+			}
+			st.Close()
+		})
+		sess := Start(NewFramer(c, c), false, func(st *Stream) { failHandler(t, st) })
+		st, err := sess.Open(http.Header{":path": {"/"}}, ControlFlagFin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("read %d bytes want %d", len(got), n)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func BenchmarkDataOnUnknownStreams(b *testing.B) {
+	c, s := pipeConn()
+	sess := Start(NewFramer(s, s), true, func(st *Stream) { st.Reset(RefusedStream) })
+	go io.Copy(ioutil.Discard, c)
+	cfr := NewFramer(c, c)
+	maxg := runtime.NumGoroutine()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Every frame draws an INVALID_STREAM reset.
+		f := &DataFrame{StreamId: StreamId(2*i + 1), Data: []byte{0}}
+		if err := cfr.WriteFrame(f); err != nil {
+			b.Fatal(err)
+		}
+		if i%1000 == 0 {
+			if n := runtime.NumGoroutine(); n > maxg {
+				maxg = n
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(maxg), "max-goroutines")
+	c.Close()
+	sess.Wait()
+	s.Close()
+}
+
+// BenchmarkSynStreamLatency measures the time from Open
+// to SYN_REPLY for streams opened concurrently, so that
+// header blocks queue up behind one another.
+func BenchmarkSynStreamLatency(b *testing.B) {
+	c, s := pipeConn()
+	h := http.Header{
+		":method":    {"GET"},
+		":path":      {"/"},
+		":version":   {"HTTP/1.1"},
+		":host":      {"example.com"},
+		":scheme":    {"https"},
+		"User-Agent": {"bench"},
+		"Accept":     {"*/*"},
+	}
+	Start(NewFramer(s, s), true, func(st *Stream) {
+		st.Reply(http.Header{":status": {"200"}}, ControlFlagFin)
+	})
+	sess := Start(NewFramer(c, c), false, nil)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			st, err := sess.Open(h, ControlFlagFin)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if st.Header() == nil {
+				b.Error("no reply")
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	c.Close()
+	s.Close()
+}
+
+// BenchmarkStreamCopy compares io.Copy to a stream
+// with and without Stream.ReadFrom.
+func BenchmarkStreamCopy(b *testing.B) {
+	b.Run("ReadFrom", func(b *testing.B) {
+		benchmarkStreamCopy(b, func(st *Stream) io.Writer { return st })
+	})
+	b.Run("Write", func(b *testing.B) {
+		benchmarkStreamCopy(b, func(st *Stream) io.Writer { return struct{ io.Writer }{st} })
+	})
+}
+
+func benchmarkStreamCopy(b *testing.B, w func(*Stream) io.Writer) {
+	const size = 1 << 20
+	c, s := pipeConn()
+	Start(NewFramer(s, s), true, func(st *Stream) {
+		st.Reply(http.Header{":status": {"200"}}, 0)
+		io.Copy(ioutil.Discard, st)
+		st.Close()
+	})
+	sess := Start(NewFramer(c, c), false, nil)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		st, err := sess.Open(http.Header{":path": {"/"}}, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		st.Header() // wait for the reply
+		if _, err := io.Copy(w(st), io.LimitReader(zeroReader{}, size)); err != nil {
+			b.Fatal(err)
+		}
+		st.Close()
+		io.Copy(ioutil.Discard, st)
+	}
+	b.StopTimer()
+	c.Close()
+	s.Close()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func BenchmarkWriteFlushInterval(b *testing.B) {
+	for _, d := range []time.Duration{0, time.Millisecond} {
+		b.Run(d.String(), func(b *testing.B) { benchmarkWriteFlush(b, d) })
+	}
+}
+
+// benchmarkWriteFlush measures a burst of small DATA frames
+// sent by the server in reply to each request. It reports the
+// number of calls to the underlying Write per request.
+func benchmarkWriteFlush(b *testing.B, d time.Duration) {
+	c, s := pipeConn()
+	w := &countWriter{w: s}
+	sess := NewSession(NewFramer(w, s), true, func(st *Stream) {
+		st.Reply(http.Header{"X": {"y"}}, 0)
+		for i := 0; i < 8; i++ {
+			st.Write([]byte("hello"))
+		}
+		st.Close()
+	})
+	sess.WriteFlushInterval = d
+	go sess.Run()
+	cfr := NewFramer(c, c)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := &SynStreamFrame{StreamId: StreamId(2*i + 1), Headers: http.Header{"X": {"y"}}}
+		f.CFHeader.Flags = ControlFlagFin
+		if err := cfr.WriteFrame(f); err != nil {
+			b.Fatal(err)
+		}
+		for {
+			f, err := cfr.ReadFrame()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if f, ok := f.(*DataFrame); ok && f.Flags&DataFlagFin != 0 {
+				break
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&w.n))/float64(b.N), "writes/op")
+	go io.Copy(ioutil.Discard, c)
+	c.Close()
+	sess.Wait()
+	s.Close()
+}
+
+func BenchmarkInterleavedStreams(b *testing.B) {
+	for _, d := range []time.Duration{0, time.Millisecond} {
+		b.Run(d.String(), func(b *testing.B) { benchmarkInterleaved(b, d) })
+	}
+}
+
+// benchmarkInterleaved measures 100 concurrent streams,
+// each sending several small DATA frames, so that frames
+// from different streams interleave on the connection.
+// It reports the number of calls to the underlying Write
+// for each batch of 100 streams.
+func benchmarkInterleaved(b *testing.B, d time.Duration) {
+	const nstream = 100
+	c, s := pipeConn()
+	w := &countWriter{w: s}
+	sess := NewSession(NewFramer(w, s), true, func(st *Stream) {
+		st.Reply(http.Header{"X": {"y"}}, 0)
+		for i := 0; i < 8; i++ {
+			st.Write([]byte("hello"))
+		}
+		st.Close()
+	})
+	sess.WriteFlushInterval = d
+	go sess.Run()
+	cfr := NewFramer(c, c)
+	id := StreamId(1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < nstream; j++ {
+			f := &SynStreamFrame{StreamId: id, Headers: http.Header{"X": {"y"}}}
+			f.CFHeader.Flags = ControlFlagFin
+			if err := cfr.WriteFrame(f); err != nil {
+				b.Fatal(err)
+			}
+			id += 2
+		}
+		for n := 0; n < nstream; {
+			f, err := cfr.ReadFrame()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if f, ok := f.(*DataFrame); ok && f.Flags&DataFlagFin != 0 {
+				n++
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&w.n))/float64(b.N), "writes/op")
+	go io.Copy(ioutil.Discard, c)
+	c.Close()
+	sess.Wait()
+	s.Close()
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&w.n, 1)
+	return w.w.Write(p)
+}
+
+func pubdiff(t *testing.T, prefix string, have, want interface{}) {
+	hv := reflect.Indirect(reflect.ValueOf(have))
+	wv := reflect.Indirect(reflect.ValueOf(want))
+	if hv.Type() != wv.Type() {
+		t.Errorf("%s: type = %v want %v", prefix, hv.Type(), wv.Type())
+		hf, ok1 := have.(Frame)
+		wf, ok2 := want.(Frame)
+		if ok1 && ok2 {
+			t.Errorf("%s: have\n%s\nwant\n%s", prefix, DumpFrame(hf), DumpFrame(wf))
+		}
+		return
 	}
 	switch hv.Kind() {
 	case reflect.Struct:
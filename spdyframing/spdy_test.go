@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/base64"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -25,7 +26,7 @@ func TestHeaderParsing(t *testing.T) {
 	var headerValueBlockBuf bytes.Buffer
 	writeHeaderValueBlock(&headerValueBlockBuf, HeadersFixture)
 	const bogusStreamId = 1
-	newHeaders, err := parseHeaderValueBlock(&headerValueBlockBuf, bogusStreamId)
+	newHeaders, err := parseHeaderValueBlock(&headerValueBlockBuf, bogusStreamId, nil)
 	if err != nil {
 		t.Fatal("parseHeaderValueBlock:", err)
 	}
@@ -34,6 +35,45 @@ func TestHeaderParsing(t *testing.T) {
 	}
 }
 
+func TestHeaderOrder(t *testing.T) {
+	h := http.Header{
+		"Accept":     {"*/*"},
+		":host":      {"example.com"},
+		"User-Agent": {"test"},
+		":version":   {"HTTP/1.1"},
+		":scheme":    {"https"},
+		":path":      {"/"},
+		":method":    {"GET"},
+	}
+	want := []string{":method", ":path", ":scheme", ":version", ":host", "accept", "user-agent"}
+	var first []byte
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		writeHeaderValueBlock(&buf, h)
+		if first == nil {
+			first = buf.Bytes()
+		} else if !bytes.Equal(buf.Bytes(), first) {
+			t.Fatalf("header block %q differs from %q", buf.Bytes(), first)
+		}
+	}
+	var got []string
+	r := bytes.NewReader(first)
+	var n uint32
+	binary.Read(r, binary.BigEndian, &n)
+	for i := uint32(0); i < n; i++ {
+		var size uint32
+		binary.Read(r, binary.BigEndian, &size)
+		name := make([]byte, size)
+		io.ReadFull(r, name)
+		binary.Read(r, binary.BigEndian, &size)
+		io.CopyN(ioutil.Discard, r, int64(size))
+		got = append(got, string(name))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("names = %q want %q", got, want)
+	}
+}
+
 func TestCreateParseSynStreamFrameCompressionDisable(t *testing.T) {
 	buffer := new(bytes.Buffer)
 	// Fixture framer for no compression test.
@@ -603,3 +643,132 @@ func checkZeroStreamId(t *testing.T, frame string, method string, err error) {
 		t.Errorf("%s ZeroStreamId, incorrect error %#v, frame %s", method, eerr, frame)
 	}
 }
+
+func TestFramerCompressionLevel(t *testing.T) {
+	levels := []int{zlib.BestSpeed, zlib.DefaultCompression, zlib.BestCompression}
+	for _, level := range levels {
+		buffer := new(bytes.Buffer)
+		framer := NewFramer(buffer, buffer)
+		if err := framer.SetCompressionLevel(level); err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		for i := 0; i < 2; i++ {
+			want := &SynStreamFrame{StreamId: StreamId(2*i + 1), Headers: HeadersFixture}
+			if err := framer.WriteFrame(want); err != nil {
+				t.Fatalf("level %d: WriteFrame: %v", level, err)
+			}
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				t.Fatalf("level %d: ReadFrame: %v", level, err)
+			}
+			got, ok := frame.(*SynStreamFrame)
+			if !ok || !reflect.DeepEqual(got.Headers, want.Headers) {
+				t.Errorf("level %d: got %s want %s", level, DumpFrame(frame), DumpFrame(want))
+			}
+		}
+	}
+	if err := NewFramer(nil, nil).SetCompressionLevel(42); err == nil {
+		t.Error("SetCompressionLevel(42) succeeded")
+	}
+}
+
+// BenchmarkHeaderCompression shows the CPU cost of each
+// compression level alongside the size of the header
+// blocks it writes, in bytes/frame.
+func BenchmarkHeaderCompression(b *testing.B) {
+	h := http.Header{
+		":method":         {"GET"},
+		":path":           {"/search?q=spdy&hl=en"},
+		":version":        {"HTTP/1.1"},
+		":host":           {"www.example.com"},
+		":scheme":         {"https"},
+		"accept":          {"text/html,application/xhtml+xml;q=0.9,*/*;q=0.8"},
+		"accept-encoding": {"gzip, deflate"},
+		"accept-language": {"en-US,en;q=0.5"},
+		"cookie":          {"session=0123456789abcdef; theme=dark; tz=UTC"},
+		"user-agent":      {"Mozilla/5.0 (X11; Linux x86_64; rv:30.0) Gecko/20100101"},
+	}
+	levels := []struct {
+		name  string
+		level int
+	}{
+		{"BestSpeed", zlib.BestSpeed},
+		{"Default", zlib.DefaultCompression},
+		{"BestCompression", zlib.BestCompression},
+	}
+	for _, l := range levels {
+		b.Run(l.name, func(b *testing.B) {
+			var buf bytes.Buffer
+			var n int
+			framer := NewFramer(&buf, nil)
+			if err := framer.SetCompressionLevel(l.level); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				f := &SynStreamFrame{StreamId: StreamId(2*i + 1), Headers: h}
+				if err := framer.WriteFrame(f); err != nil {
+					b.Fatal(err)
+				}
+				n += buf.Len()
+				buf.Reset()
+			}
+			b.ReportMetric(float64(n)/float64(b.N), "bytes/frame")
+		})
+	}
+}
+
+// Each header block must end with a sync flush, so a peer
+// can decode it from that frame's bytes alone, without
+// waiting for more data.
+func TestHeaderBlockSyncFlush(t *testing.T) {
+	var out bytes.Buffer
+	f := NewFramer(&out, nil)
+	var blocks [][]byte
+	frames := []Frame{
+		&SynStreamFrame{StreamId: 1, Headers: HeadersFixture},
+		&HeadersFrame{StreamId: 1, Headers: http.Header{"Trailer": {"x"}}},
+	}
+	for i, frame := range frames {
+		if err := f.WriteFrame(frame); err != nil {
+			t.Fatalf("#%d: WriteFrame: %v", i, err)
+		}
+		n := 18 // SYN_STREAM fixed fields
+		if i > 0 {
+			n = 12 // HEADERS fixed fields
+		}
+		blocks = append(blocks, append([]byte(nil), out.Bytes()[n:]...))
+		out.Reset()
+	}
+
+	// The decompressor's source holds only the blocks given
+	// so far, and reports EOF when they run out.
+	var src bytes.Buffer
+	src.Write(blocks[0])
+	zr, err := zlib.NewReaderDict(&src, []byte(headerDictionary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		if i > 0 {
+			src.Write(blocks[i])
+		}
+		h, err := parseHeaderValueBlock(zr, 1, nil)
+		if err != nil {
+			t.Fatalf("#%d: parse: %v", i, err)
+		}
+		var want http.Header
+		switch frame := frame.(type) {
+		case *SynStreamFrame:
+			want = frame.Headers
+		case *HeadersFrame:
+			want = frame.Headers
+		}
+		if !reflect.DeepEqual(h, want) {
+			t.Errorf("#%d: header = %v want %v", i, h, want)
+		}
+		if src.Len() != 0 {
+			t.Errorf("#%d: %d bytes of block left unread", i, src.Len())
+		}
+	}
+}
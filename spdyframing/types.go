@@ -44,6 +44,11 @@ type DataFlags uint8
 
 const (
 	DataFlagFin DataFlags = 0x01
+
+	// DataFlagCompress marks a compressed DATA frame.
+	// It's not supported; a Session resets any stream
+	// that gets a DATA frame with it set.
+	DataFlagCompress DataFlags = 0x02
 )
 
 // MaxDataLength is the maximum number of bytes that can be stored in one frame.
@@ -253,6 +258,16 @@ type Framer struct {
 	r                         io.Reader
 	headerReader              io.LimitedReader
 	headerDecompressor        io.ReadCloser
+	headerSize                HeaderSize // of the last header block read
+	keepRaw                   bool
+	rawHeader                 []HeaderField // of the last header block read, if keepRaw
+}
+
+// A HeaderField is one name/value pair of a header block as
+// it was sent, before any lowercasing or canonicalization.
+// Multiple values are left joined by NUL bytes.
+type HeaderField struct {
+	Name, Value string
 }
 
 // NewFramer allocates a new Framer for a given SPDY connection, repesented by
@@ -270,3 +285,26 @@ func NewFramer(w io.Writer, r io.Reader) *Framer {
 		r:                r,
 	}
 }
+
+// KeepRawHeader sets whether f records the fields of each
+// header block it reads, in order, for RawHeader. It costs
+// a second copy of every header, so it is off by default.
+func (f *Framer) KeepRawHeader(keep bool) {
+	f.keepRaw = keep
+}
+
+// SetCompressionLevel sets the zlib compression level for
+// header blocks written by f. The default is
+// zlib.BestCompression; zlib.BestSpeed costs less CPU
+// for somewhat larger frames. It must be called before
+// f writes any frame that carries a header block, because
+// the peer decompresses all of them as a single stream.
+func (f *Framer) SetCompressionLevel(level int) error {
+	f.headerBuf.Reset()
+	c, err := zlib.NewWriterLevelDict(f.headerBuf, level, []byte(headerDictionary))
+	if err != nil {
+		return err
+	}
+	f.headerCompressor = c
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -152,13 +153,56 @@ func writeControlFrameHeader(w io.Writer, h ControlFrameHeader) error {
 	return nil
 }
 
+// Pseudo-header fields are written first, in this order.
+// Some peers are strict about it.
+var pseudoHeaderRank = map[string]int{
+	":method":  1,
+	":path":    2,
+	":scheme":  3,
+	":version": 4,
+	":host":    5,
+	":status":  6,
+}
+
+// headerOrder returns the field names in h in the order they
+// should be written: the pseudo-header fields first, then the
+// rest sorted by name, so that the output is deterministic.
+func headerOrder(h http.Header) []string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := strings.ToLower(names[i]), strings.ToLower(names[j])
+		ra, rb := headerRank(a), headerRank(b)
+		if ra != rb {
+			return ra < rb
+		}
+		return a < b
+	})
+	return names
+}
+
+// headerRank orders known pseudo-header fields first,
+// then unknown ones, then regular fields.
+func headerRank(name string) int {
+	if r, ok := pseudoHeaderRank[name]; ok {
+		return r
+	}
+	if strings.HasPrefix(name, ":") {
+		return len(pseudoHeaderRank) + 1
+	}
+	return len(pseudoHeaderRank) + 2
+}
+
 func writeHeaderValueBlock(w io.Writer, h http.Header) (n int, err error) {
 	n = 0
 	if err = binary.Write(w, binary.BigEndian, uint32(len(h))); err != nil {
 		return
 	}
 	n += 2
-	for name, values := range h {
+	for _, name := range headerOrder(h) {
+		values := h[name]
 		if err = binary.Write(w, binary.BigEndian, uint32(len(name))); err != nil {
 			return
 		}
@@ -194,7 +238,11 @@ func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
 		return
 	}
 	if !f.headerCompressionDisabled {
-		f.headerCompressor.Flush()
+		// Sync flush, so the peer can decode the
+		// whole block without waiting for more.
+		if err = f.headerCompressor.Flush(); err != nil {
+			return
+		}
 	}
 
 	// Set ControlFrameHeader.
@@ -238,7 +286,9 @@ func (f *Framer) writeSynReplyFrame(frame *SynReplyFrame) (err error) {
 		return
 	}
 	if !f.headerCompressionDisabled {
-		f.headerCompressor.Flush()
+		if err = f.headerCompressor.Flush(); err != nil {
+			return
+		}
 	}
 
 	// Set ControlFrameHeader.
@@ -273,7 +323,9 @@ func (f *Framer) writeHeadersFrame(frame *HeadersFrame) (err error) {
 		return
 	}
 	if !f.headerCompressionDisabled {
-		f.headerCompressor.Flush()
+		if err = f.headerCompressor.Flush(); err != nil {
+			return
+		}
 	}
 
 	// Set ControlFrameHeader.
@@ -0,0 +1,206 @@
+package spdy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// These tests run a real server on a loopback port,
+// so that TLS negotiation picks the protocol.
+
+// startTLSServer serves h with Server.ServeTLS on a loopback
+// port, using a new self-signed certificate. It returns the
+// address and a func to stop the server.
+func startTLSServer(t *testing.T, h http.Handler) (addr string, stop func()) {
+	if testing.Short() {
+		t.Skip("skipping loopback TLS test in short mode")
+	}
+	certFile, keyFile := writeCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Server: http.Server{Handler: h}}
+	done := make(chan bool)
+	go func() {
+		s.ServeTLS(l, certFile, keyFile)
+		close(done)
+	}()
+	return l.Addr().String(), func() {
+		l.Close()
+		<-done
+	}
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1
+// and its key to files in a temporary directory.
+func writeCert(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"spdy test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, name, typ string, b []byte) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: b}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialTLS connects to addr offering protos
+// and returns the connection.
+func dialTLS(t *testing.T, addr string, protos ...string) *tls.Conn {
+	c, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         protos,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTLSRoundTrip(t *testing.T) {
+	addr, stop := startTLSServer(t, echoHandler(t))
+	defer stop()
+
+	c := dialTLS(t, addr, "spdy/3", "http/1.1")
+	defer c.Close()
+	if p := c.ConnectionState().NegotiatedProtocol; p != "spdy/3" {
+		t.Fatalf("negotiated %q want %q", p, "spdy/3")
+	}
+	client := &http.Client{Transport: &Conn{Conn: c}}
+
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("GET StatusCode = %d want 200", resp.StatusCode)
+	}
+
+	const body = "hello, spdy"
+	resp, err = client.Post("https://"+addr+"/", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if string(b) != body {
+		t.Errorf("POST body = %q want %q", b, body)
+	}
+}
+
+func TestTLSNewClientConn(t *testing.T) {
+	addr, stop := startTLSServer(t, echoHandler(t))
+	defer stop()
+
+	conn, err := NewClientConn(dialTLS(t, addr, "spdy/3", "http/1.1"))
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	defer conn.Conn.Close()
+	req, _ := http.NewRequest("GET", "https://"+addr+"/", nil)
+	resp, err := conn.RoundTrip(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("StatusCode = %d want 200", resp.StatusCode)
+	}
+
+	// Offering only HTTP/1.1 can't end in SPDY.
+	c := dialTLS(t, addr, "http/1.1")
+	defer c.Close()
+	if _, err := NewClientConn(c); err == nil {
+		t.Error("NewClientConn succeeded after negotiating http/1.1")
+	}
+}
+
+// A client that doesn't offer spdy/3 gets HTTP/1.1
+// from the same server.
+func TestTLSServerHTTPFallback(t *testing.T) {
+	addr, stop := startTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 1 {
+			t.Errorf("Proto = %q want HTTP/1.x", r.Proto)
+		}
+	}))
+	defer stop()
+
+	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 || resp.StatusCode != 200 {
+		t.Errorf("got %s %s want HTTP/1.1 200", resp.Proto, resp.Status)
+	}
+}
+
+// A server that doesn't speak SPDY doesn't choose spdy/3,
+// which tells the client to fall back to HTTP/1.1.
+func TestTLSNoSPDYServer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping loopback TLS test in short mode")
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+	c := dialTLS(t, ts.Listener.Addr().String(), "spdy/3", "http/1.1")
+	defer c.Close()
+	if p := c.ConnectionState().NegotiatedProtocol; p == "spdy/3" {
+		t.Errorf("negotiated %q from a server without SPDY", p)
+	}
+}
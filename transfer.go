@@ -1,12 +1,15 @@
 package spdy
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+
+	framing "github.com/kr/spdy/spdyframing"
 )
 
 // SPDY 3 prohibits these fields.
@@ -80,6 +83,7 @@ func fixLength(isResponse bool, status int, requestMethod string, h http.Header)
 type body struct {
 	r      io.Reader
 	closed bool
+	sawEOF bool
 
 	// non-nil (Response or Request) value means copy trailer
 	hdr interface{}
@@ -89,7 +93,8 @@ type body struct {
 	// should be considered incomplete until EOF.
 	trailer http.Header
 
-	res *response // response writer for server requests, else nil
+	res *response       // response writer for server requests, else nil
+	st  *framing.Stream // stream for client responses, else nil
 }
 
 func (b *body) Read(p []byte) (n int, err error) {
@@ -97,6 +102,9 @@ func (b *body) Read(p []byte) (n int, err error) {
 		return 0, http.ErrBodyReadAfterClose
 	}
 	n, err = b.r.Read(p)
+	if err == io.EOF {
+		b.sawEOF = true
+	}
 	if err == io.EOF && b.trailer != nil {
 		b.copyTrailer()
 		b.hdr = nil
@@ -104,6 +112,12 @@ func (b *body) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// stream returns the stream of a client response body,
+// or nil. See ResponseStream.
+func (b *body) stream() *framing.Stream {
+	return b.st
+}
+
 func (b *body) copyTrailer() {
 	if b.trailer == nil {
 		return
@@ -125,6 +139,23 @@ func (b *body) Close() error {
 	}
 	var err error
 	switch {
+	case b.st != nil && !b.sawEOF && b.r != eofReader:
+		// A client response body, closed before the end.
+		// Reset the stream rather than reading the rest, so
+		// the server stops sending and the stream no longer
+		// counts against the connection.
+		select {
+		case <-b.st.Done():
+		default:
+			b.st.Reset(framing.Cancel)
+		}
+	case b.res != nil:
+		// A server request body. Don't wait for the rest
+		// of it; drop what's buffered and anything that
+		// arrives later. Once the response is done,
+		// finishRequest resets the stream if the client
+		// is still sending.
+		err = b.res.stream.CloseRead()
 	case b.hdr == nil:
 		// no trailer. no point in reading to EOF.
 	case false:
@@ -140,6 +171,85 @@ func (b *body) Close() error {
 	return err
 }
 
+// finReader is like io.LimitReader, but once it has
+// returned n bytes it goes on reading r until r itself
+// reports EOF, discarding anything past the limit.
+// This way, whatever comes with the end of the stream,
+// such as the trailer, is in place when Read returns EOF.
+// If r ends before n bytes, Read returns io.ErrUnexpectedEOF.
+type finReader struct {
+	r io.Reader
+	n int64
+
+	// excess, if non-nil, is called instead of discarding
+	// when r holds more than n bytes. Read then returns EOF
+	// without waiting for the end of r.
+	excess func()
+}
+
+func (f *finReader) Read(p []byte) (n int, err error) {
+	if f.n <= 0 {
+		if f.excess == nil {
+			_, err = io.Copy(ioutil.Discard, f.r)
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		var b [1]byte
+		for n == 0 && err == nil {
+			n, err = f.r.Read(b[:])
+		}
+		if n > 0 {
+			f.excess()
+			f.excess = nil
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	if int64(len(p)) > f.n {
+		p = p[:f.n]
+	}
+	n, err = f.r.Read(p)
+	f.n -= int64(n)
+	if err == io.EOF && f.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+var errBodyTooLong = errors.New("spdy: body longer than Content-Length")
+
+// lengthReader reads exactly n bytes from r and then expects
+// r to end. It returns io.ErrUnexpectedEOF if r ends early,
+// and errBodyTooLong if r holds more than n bytes.
+type lengthReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *lengthReader) Read(p []byte) (n int, err error) {
+	if l.n <= 0 {
+		var b [1]byte
+		for n == 0 && err == nil {
+			n, err = l.r.Read(b[:])
+		}
+		if n > 0 {
+			return 0, errBodyTooLong
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	if err == io.EOF && l.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
 type badStringError struct {
 	what string
 	str  string
@@ -0,0 +1,358 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	framing "github.com/kr/spdy/spdyframing"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Transport is an http.RoundTripper that makes requests
+// over SPDY when the server supports it. It dials one TLS
+// connection to each host, offering spdy/3, and sends every
+// request for that host on the resulting Conn until it closes.
+// Requests that aren't https, and requests to servers that
+// pick another protocol, go to Fallback instead.
+type Transport struct {
+	// TLSClientConfig is used to dial hosts. Its NextProtos,
+	// if empty, is set to spdy/3 and http/1.1, and its
+	// ServerName, if empty, to the host being dialed.
+	TLSClientConfig *tls.Config
+
+	// DialTLS, if non-nil, replaces tls.Dial for connecting
+	// to addr, a host:port pair. If the connection it returns
+	// is a *tls.Conn, Transport checks the negotiated protocol
+	// as usual; any other net.Conn is taken to speak SPDY.
+	DialTLS func(network, addr string) (net.Conn, error)
+
+	// Fallback handles requests that don't go over SPDY.
+	// If nil, http.DefaultTransport is used.
+	Fallback http.RoundTripper
+
+	// ConnTemplate, if non-nil, configures the connections
+	// Transport makes. Each new Conn copies its settings, such
+	// as Timeout, KeepAlive, and ErrorLog, before it starts.
+	// Its Conn field is ignored.
+	ConnTemplate *Conn
+
+	// ForceSPDY makes RoundTrip return an error, instead of
+	// using Fallback, for requests that can't go over SPDY,
+	// so that nothing is silently sent with HTTP/1.1.
+	ForceSPDY bool
+
+	// MinBackoff and MaxBackoff bound how long Transport waits
+	// before dialing a host again after a failed dial. The wait
+	// starts near MinBackoff, doubles with each failure up to
+	// MaxBackoff, and is reset by a successful dial. Each wait
+	// is jittered, so clients that failed together don't all
+	// come back at once. If zero, they are 100 milliseconds
+	// and 30 seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostConn
+}
+
+// hostConn is the state Transport keeps for one host.
+type hostConn struct {
+	conn     *Conn
+	http1    bool          // the host didn't negotiate spdy/3
+	dialing  chan struct{} // closed when the dial in progress ends
+	failures int           // consecutive failed dials
+	next     time.Time     // no dial before this
+}
+
+// RoundTrip implements interface http.RoundTripper.
+//
+// RoundTrip sends r again, on a new connection or through
+// Fallback, only if the server can't have processed it: the
+// connection closed or got GOAWAY before the stream opened,
+// or the server refused the stream with GOAWAY or with
+// RST_STREAM and REFUSED_STREAM. In the last two cases, the
+// first attempt may have read part of the body, so RoundTrip
+// gets a fresh copy with r.GetBody; a request with a body but
+// no GetBody isn't retried then.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme != "https" {
+		if t.ForceSPDY {
+			closeBody(r.Body)
+			return nil, fmt.Errorf("spdy: can't send %s request with ForceSPDY", r.URL.Scheme)
+		}
+		return t.fallback().RoundTrip(r)
+	}
+	addr := hostPort(r.URL)
+	body := r.Body
+	for try := 1; ; try++ {
+		c, err := t.getConn(r.Context(), addr)
+		if err != nil {
+			closeBody(body)
+			return nil, err
+		}
+		r1 := *r // Conn.RoundTrip clears Body
+		r1.Body = body
+		if c == nil {
+			resp, err := t.fallback().RoundTrip(&r1)
+			if err != nil {
+				return nil, err
+			}
+			resp.Request = r
+			return resp, nil
+		}
+		resp, opened, err := c.roundTrip(&r1)
+		if err == nil {
+			resp.Request = r
+			return resp, nil
+		}
+		if err == framing.ErrSessionClosing || err == framing.ErrGoingAway {
+			t.evict(addr, c)
+		}
+		if try == maxTries || !refused(err) {
+			closeBody(body)
+			return nil, err
+		}
+		if opened && body != nil && body != http.NoBody {
+			// The body may be partly sent, and the
+			// copy to the stream may still be reading it.
+			closeBody(body)
+			if r.GetBody == nil {
+				return nil, err
+			}
+			if body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// maxTries is the most times Transport.RoundTrip
+// sends a request, counting the first.
+const maxTries = 3
+
+// refused reports whether err, from Conn.RoundTrip,
+// means the server didn't process the request.
+func refused(err error) bool {
+	if err == framing.ErrSessionClosing || err == framing.ErrGoingAway {
+		return true
+	}
+	status, ok := framing.ResetStatus(err)
+	return ok && status == framing.RefusedStream
+}
+
+func closeBody(body io.ReadCloser) {
+	if body != nil {
+		body.Close()
+	}
+}
+
+// CloseIdleConnections closes every connection that has
+// no open streams. It implements the method of the same
+// name that http.Client looks for.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, h := range t.hosts {
+		if h.conn != nil && h.conn.NumStreams() == 0 {
+			h.conn.Conn.Close()
+			h.conn = nil
+		}
+	}
+	if c, ok := t.Fallback.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func (t *Transport) fallback() http.RoundTripper {
+	if t.Fallback != nil {
+		return t.Fallback
+	}
+	return http.DefaultTransport
+}
+
+// getConn returns the Conn for addr, dialing it if need be.
+// It returns a nil Conn if addr doesn't speak SPDY.
+// If the last dial to addr failed, getConn waits out the
+// backoff first, or until ctx is done.
+func (t *Transport) getConn(ctx context.Context, addr string) (*Conn, error) {
+	for {
+		t.mu.Lock()
+		if t.hosts == nil {
+			t.hosts = make(map[string]*hostConn)
+		}
+		h := t.hosts[addr]
+		if h == nil {
+			h = new(hostConn)
+			t.hosts[addr] = h
+		}
+		if h.conn != nil && h.conn.s.Closed() {
+			h.conn = nil
+		}
+		if h.conn != nil || h.http1 {
+			c := h.conn
+			t.mu.Unlock()
+			return c, nil
+		}
+		if ch := h.dialing; ch != nil {
+			t.mu.Unlock()
+			select {
+			case <-ch:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		ch := make(chan struct{})
+		h.dialing = ch
+		wait := time.Until(h.next)
+		t.mu.Unlock()
+
+		if err := sleep(ctx, wait); err != nil {
+			t.mu.Lock()
+			h.dialing = nil
+			close(ch)
+			t.mu.Unlock()
+			return nil, err
+		}
+		c, err := t.dial(addr)
+
+		t.mu.Lock()
+		h.dialing = nil
+		close(ch)
+		switch {
+		case err != nil:
+			h.failures++
+			h.next = time.Now().Add(t.backoff(h.failures))
+		case c == nil:
+			h.failures = 0
+			h.http1 = true
+		default:
+			h.failures = 0
+			h.conn = c
+		}
+		t.mu.Unlock()
+		return c, err
+	}
+}
+
+// dial connects to addr and starts a Conn on the connection.
+// It returns a nil Conn if the server chose a protocol other
+// than spdy/3, or an error if ForceSPDY is set.
+func (t *Transport) dial(addr string) (*Conn, error) {
+	var c net.Conn
+	var err error
+	if t.DialTLS != nil {
+		c, err = t.DialTLS("tcp", addr)
+	} else {
+		c, err = tls.Dial("tcp", addr, t.tlsConfig(addr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		if p := tc.ConnectionState().NegotiatedProtocol; p != "spdy/3" {
+			c.Close()
+			if t.ForceSPDY {
+				return nil, fmt.Errorf("spdy: %s negotiated protocol %q, not spdy/3", addr, p)
+			}
+			return nil, nil
+		}
+	}
+	conn := &Conn{Conn: c}
+	if tc := t.ConnTemplate; tc != nil {
+		conn.ModifyRequestHeader = tc.ModifyRequestHeader
+		conn.Timeout = tc.Timeout
+		conn.KeepAlive = tc.KeepAlive
+		conn.HeaderCompressionLevel = tc.HeaderCompressionLevel
+		conn.LogFrames = tc.LogFrames
+		conn.ErrorLog = tc.ErrorLog
+	}
+	if err := conn.start(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *Transport) tlsConfig(addr string) *tls.Config {
+	var cfg *tls.Config
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	} else {
+		cfg = new(tls.Config)
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"spdy/3", "http/1.1"}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return cfg
+}
+
+// evict removes c from the pool, if it's still there,
+// so that the next request for addr dials a new one.
+func (t *Transport) evict(addr string, c *Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h := t.hosts[addr]; h != nil && h.conn == c {
+		h.conn = nil
+	}
+}
+
+// backoff returns how long to wait before the next dial
+// after n consecutive failures: a random duration between
+// half and all of MinBackoff doubled n-1 times, capped at
+// MaxBackoff.
+func (t *Transport) backoff(n int) time.Duration {
+	min, max := t.MinBackoff, t.MaxBackoff
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	d := min
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hostPort returns the host and port of u,
+// with the https port if u doesn't have one.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
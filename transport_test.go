@@ -0,0 +1,438 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	framing "github.com/kr/spdy/spdyframing"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeDialer returns a DialTLS func whose connections are
+// served by h, and a func that reports how many it made.
+func pipeDialer(t *testing.T, h http.Handler) (dial func(network, addr string) (net.Conn, error), dials func() int) {
+	var mu sync.Mutex
+	n := 0
+	dial = func(network, addr string) (net.Conn, error) {
+		mu.Lock()
+		n++
+		mu.Unlock()
+		cconn, sconn := pipeConn()
+		go serveConn(t, h, sconn)
+		return cconn, nil
+	}
+	dials = func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+	return dial, dials
+}
+
+func TestTransportPool(t *testing.T) {
+	dial, dials := pipeDialer(t, echoHandler(t))
+	tr := &Transport{DialTLS: dial}
+	client := &http.Client{Transport: tr}
+	get := func() {
+		resp, err := client.Get("https://example.com/")
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		resp.Body.Close()
+		if !IsSPDY(resp) {
+			t.Error("response didn't come over SPDY")
+		}
+	}
+
+	get()
+	get()
+	if n := dials(); n != 1 {
+		t.Errorf("dials = %d want 1", n)
+	}
+
+	// Once the connection is gone, the next request dials again.
+	c := tr.hosts["example.com:443"].conn
+	tr.CloseIdleConnections()
+	c.s.Wait()
+	get()
+	if n := dials(); n != 2 {
+		t.Errorf("dials = %d want 2", n)
+	}
+}
+
+// Connections take their settings from ConnTemplate.
+func TestTransportConnTemplate(t *testing.T) {
+	dial, _ := pipeDialer(t, echoHandler(t))
+	tmpl := &Conn{
+		ModifyRequestHeader: func(h http.Header) { h.Set("X-Template", "yes") },
+		Timeout:             time.Minute,
+		ErrorLog:            log.New(ioutil.Discard, "", 0),
+	}
+	tr := &Transport{DialTLS: dial, ConnTemplate: tmpl}
+	resp, err := (&http.Client{Transport: tr}).Get("https://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if g := resp.Header.Get("X-Template"); g != "yes" {
+		t.Errorf("echoed X-Template = %q want %q", g, "yes")
+	}
+	c := tr.hosts["example.com:443"].conn
+	if c.Timeout != tmpl.Timeout || c.ErrorLog != tmpl.ErrorLog {
+		t.Errorf("conn Timeout, ErrorLog = %v, %p want %v, %p", c.Timeout, c.ErrorLog, tmpl.Timeout, tmpl.ErrorLog)
+	}
+}
+
+func TestTransportBackoff(t *testing.T) {
+	const (
+		min = 20 * time.Millisecond
+		max = 40 * time.Millisecond
+	)
+	good, _ := pipeDialer(t, echoHandler(t))
+	var (
+		fail  = 3
+		times []time.Time
+	)
+	tr := &Transport{
+		MinBackoff: min,
+		MaxBackoff: max,
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			times = append(times, time.Now())
+			if fail > 0 {
+				fail--
+				return nil, errors.New("dial failed")
+			}
+			return good(network, addr)
+		},
+	}
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 3; i++ {
+		if _, err := client.Get("https://example.com/"); err == nil {
+			t.Fatalf("request %d succeeded, want dial error", i)
+		}
+	}
+	resp, err := client.Get("https://example.com/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+
+	// Each wait is at least half the unjittered backoff,
+	// which doubles from min and stops at max.
+	for i, want := range []time.Duration{min / 2, max / 2, max / 2} {
+		if d := times[i+1].Sub(times[i]); d < want {
+			t.Errorf("wait %d = %v want at least %v", i, d, want)
+		}
+	}
+	for i := 1; i < 10; i++ {
+		if d := tr.backoff(i); d > max {
+			t.Errorf("backoff(%d) = %v want at most %v", i, d, max)
+		}
+	}
+
+	// Success resets the backoff.
+	h := tr.hosts["example.com:443"]
+	if h.failures != 0 {
+		t.Errorf("failures = %d want 0", h.failures)
+	}
+	c := h.conn
+	tr.CloseIdleConnections()
+	c.s.Wait()
+	fail = 1
+	if _, err := client.Get("https://example.com/"); err == nil {
+		t.Fatal("request succeeded, want dial error")
+	}
+	if d := time.Until(h.next); d > min {
+		t.Errorf("backoff after reset = %v want at most %v", d, min)
+	}
+}
+
+func TestTransportBackoffContext(t *testing.T) {
+	tr := &Transport{
+		MinBackoff: time.Hour,
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			return nil, errors.New("dial failed")
+		},
+	}
+	client := &http.Client{Transport: tr, Timeout: 50 * time.Millisecond}
+	if _, err := client.Get("https://example.com/"); err == nil {
+		t.Fatal("request succeeded, want dial error")
+	}
+	// The second request would wait for most of an hour,
+	// but the client gives up long before.
+	done := make(chan error)
+	go func() {
+		_, err := client.Get("https://example.com/")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("request succeeded, want timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request waited out the backoff")
+	}
+}
+
+// refuseDialer returns a DialTLS func whose connection takes
+// the first DATA frame of a request and then sends f, such as
+// GOAWAY, to refuse it partway through the upload.
+func refuseDialer(f framing.Frame) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		cconn, sconn := pipeConn()
+		go func() {
+			fr := framing.NewFramer(sconn, sconn)
+			for {
+				g, err := fr.ReadFrame()
+				if err != nil {
+					return
+				}
+				if _, ok := g.(*framing.DataFrame); ok && f != nil {
+					fr.WriteFrame(f)
+					f = nil
+				}
+			}
+		}()
+		return cconn, nil
+	}
+}
+
+// After the server refuses a request partway through the
+// body, the retry, here through the fallback, gets the whole
+// body again.
+func TestTransportRewindFallback(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping loopback TLS test in short mode")
+	}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// HTTP/1.1 handlers must read the body before writing.
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer ts.Close()
+
+	refuse := refuseDialer(&framing.GoAwayFrame{LastGoodStreamId: 0})
+	dials := 0
+	fallback := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer fallback.CloseIdleConnections()
+	tr := &Transport{
+		Fallback: fallback,
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			dials++
+			if dials == 1 {
+				return refuse(network, addr)
+			}
+			return tls.Dial(network, addr, &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"spdy/3", "http/1.1"},
+			})
+		},
+	}
+
+	body := strings.Repeat("x", 200000)
+	req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(body))
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if dials != 2 {
+		t.Errorf("dials = %d want 2", dials)
+	}
+	if IsSPDY(resp) {
+		t.Error("response came over SPDY, want fallback")
+	}
+	if resp.Request != req {
+		t.Error("resp.Request isn't the caller's request")
+	}
+	if len(b) != len(body) {
+		t.Errorf("fallback got %d bytes of body want %d", len(b), len(body))
+	}
+}
+
+// closeRecorder is a request body that notes when it's closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeRecorder) Close() error {
+	b.closed = true
+	return nil
+}
+
+// Without GetBody, a body that may be half sent
+// can't be sent again, and RoundTrip closes it.
+func TestTransportNoRewind(t *testing.T) {
+	refuse := refuseDialer(&framing.RstStreamFrame{StreamId: 1, Status: framing.RefusedStream})
+	dials := 0
+	tr := &Transport{DialTLS: func(network, addr string) (net.Conn, error) {
+		dials++
+		return refuse(network, addr)
+	}}
+	body := &closeRecorder{Reader: strings.NewReader(strings.Repeat("x", 200000))}
+	req, _ := http.NewRequest("POST", "https://example.com/", body)
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip succeeded, want error")
+	}
+	if dials != 1 {
+		t.Errorf("dials = %d want 1", dials)
+	}
+	if !body.closed {
+		t.Error("body not closed")
+	}
+}
+
+// A request that the server may have processed isn't sent
+// again, even with GetBody. Here the handler runs and then
+// resets the stream before it replies.
+func TestTransportNoReplay(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	dial, _ := pipeDialer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		w.(Aborter).Abort(framing.InternalError)
+	}))
+	tr := &Transport{DialTLS: dial}
+	req, _ := http.NewRequest("POST", "https://example.com/", strings.NewReader("charge card"))
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip succeeded, want error")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("handler ran %d times want 1", calls)
+	}
+}
+
+// A request refused with GOAWAY before its stream opened
+// goes out whole on a new connection, without GetBody,
+// since nothing read its body.
+func TestTransportGoAwayRetry(t *testing.T) {
+	got := make(chan string, 1)
+	good, _ := pipeDialer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- string(b)
+	}))
+	ready := make(chan bool)
+	dials := 0
+	tr := &Transport{DialTLS: func(network, addr string) (net.Conn, error) {
+		dials++
+		if dials > 1 {
+			return good(network, addr)
+		}
+		cconn, sconn := pipeConn()
+		go func() {
+			// Once the PING comes back, the client
+			// has handled the GOAWAY before it.
+			fr := framing.NewFramer(sconn, sconn)
+			fr.WriteFrame(&framing.GoAwayFrame{Status: framing.GoAwayOK})
+			fr.WriteFrame(&framing.PingFrame{Id: 2})
+			for {
+				f, err := fr.ReadFrame()
+				if err != nil {
+					return
+				}
+				if _, ok := f.(*framing.PingFrame); ok {
+					close(ready)
+				}
+			}
+		}()
+		return cconn, nil
+	}}
+	if _, err := tr.getConn(context.Background(), "example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	<-ready
+	req, _ := http.NewRequest("POST", "https://example.com/", ioutil.NopCloser(strings.NewReader("hello")))
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if g := <-got; g != "hello" {
+		t.Errorf("server got body %q want %q", g, "hello")
+	}
+	if dials != 2 {
+		t.Errorf("dials = %d want 2", dials)
+	}
+}
+
+// roundTripperFunc adapts a func to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestTransportForceSPDY(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping loopback TLS test in short mode")
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	fellBack := false
+	tr := &Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		ForceSPDY:       true,
+		Fallback: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			fellBack = true
+			return nil, errors.New("fallback")
+		}),
+	}
+	for _, url := range []string{ts.URL, "http://example.com/"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		_, err := tr.RoundTrip(req)
+		if err == nil || err.Error() == "fallback" {
+			t.Errorf("RoundTrip(%s) err = %v want ForceSPDY error", url, err)
+		}
+	}
+	if fellBack {
+		t.Error("ForceSPDY request went to Fallback")
+	}
+
+	// Without ForceSPDY, the same request falls back.
+	tr.ForceSPDY = false
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	if _, err := tr.RoundTrip(req); err == nil || err.Error() != "fallback" {
+		t.Errorf("RoundTrip err = %v want fallback", err)
+	}
+}
+
+// With ForceSPDY, a server that does speak SPDY works as usual.
+func TestTransportForceSPDYServer(t *testing.T) {
+	addr, stop := startTLSServer(t, echoHandler(t))
+	defer stop()
+
+	tr := &Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		ForceSPDY:       true,
+	}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	if !IsSPDY(resp) {
+		t.Error("response didn't come over SPDY")
+	}
+}